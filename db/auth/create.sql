@@ -5,7 +5,82 @@ CREATE TABLE `users` (
     `password` VARCHAR(64) NOT NULL,
     `realname` VARCHAR(128) NULL DEFAULT NULL,
     `email` VARCHAR(128) NULL DEFAULT NULL,
+    `email_verified` TINYINT(1) NOT NULL DEFAULT 0,
     `created` DATETIME NULL DEFAULT NULL,
+    `totp_secret` VARCHAR(64) NULL DEFAULT NULL,
+    `totp_enabled` TINYINT(1) NOT NULL DEFAULT 0,
+    `totp_last` BIGINT NOT NULL DEFAULT 0,
+    `recovery_codes` TEXT NULL DEFAULT NULL,
+    `roles` VARCHAR(255) NOT NULL DEFAULT 'user',
+    `disabled` TINYINT(1) NOT NULL DEFAULT 0,
     PRIMARY KEY (`username`),
     UNIQUE (`username`)
 ) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `sessions` (
+    `id` VARCHAR(64) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `tokens` (
+    `id` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `name` VARCHAR(128) NOT NULL,
+    `hash` VARCHAR(64) NOT NULL,
+    `scopes` VARCHAR(255) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `identities` (
+    `provider` VARCHAR(64) NOT NULL,
+    `subject` VARCHAR(255) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `created` DATETIME NOT NULL,
+    PRIMARY KEY (`provider`, `subject`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `email_tokens` (
+    `id` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `purpose` VARCHAR(16) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `used` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `deletions` (
+    `username` VARCHAR(128) NOT NULL,
+    `stage` VARCHAR(16) NOT NULL,
+    `objects` BIGINT NOT NULL DEFAULT 0,
+    `error` TEXT NULL DEFAULT NULL,
+    `created` DATETIME NOT NULL,
+    `updated` DATETIME NOT NULL,
+    `session` VARCHAR(64) NOT NULL DEFAULT '',
+    `scope_expired_at` DATETIME NOT NULL,
+    PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `audit` (
+    `time` DATETIME NOT NULL,
+    `event` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `actor` VARCHAR(128) NOT NULL DEFAULT '',
+    `success` TINYINT(1) NOT NULL,
+    `request_id` VARCHAR(64) NOT NULL DEFAULT '',
+    `client_ip` VARCHAR(64) NOT NULL DEFAULT '',
+    `details` TEXT NULL DEFAULT NULL,
+    KEY (`username`, `time`),
+    KEY (`time`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
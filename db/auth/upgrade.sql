@@ -0,0 +1,127 @@
+USE `apparat.auth`;
+
+-- tables and columns are only added if they do not exist yet, so that the script can be applied again
+
+CREATE TABLE IF NOT EXISTS `sessions` (
+    `id` VARCHAR(64) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS `tokens` (
+    `id` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `name` VARCHAR(128) NOT NULL,
+    `hash` VARCHAR(64) NOT NULL,
+    `scopes` VARCHAR(255) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS `identities` (
+    `provider` VARCHAR(64) NOT NULL,
+    `subject` VARCHAR(255) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `created` DATETIME NOT NULL,
+    PRIMARY KEY (`provider`, `subject`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='totp_secret') = 0,
+    'ALTER TABLE `users` ADD COLUMN `totp_secret` VARCHAR(64) NULL DEFAULT NULL',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='totp_enabled') = 0,
+    'ALTER TABLE `users` ADD COLUMN `totp_enabled` TINYINT(1) NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='totp_last') = 0,
+    'ALTER TABLE `users` ADD COLUMN `totp_last` BIGINT NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='recovery_codes') = 0,
+    'ALTER TABLE `users` ADD COLUMN `recovery_codes` TEXT NULL DEFAULT NULL',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='email_verified') = 0,
+    'ALTER TABLE `users` ADD COLUMN `email_verified` TINYINT(1) NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+CREATE TABLE IF NOT EXISTS `email_tokens` (
+    `id` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `purpose` VARCHAR(16) NOT NULL,
+    `created` DATETIME NOT NULL,
+    `expired_at` DATETIME NOT NULL,
+    `used` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='roles') = 0,
+    'ALTER TABLE `users` ADD COLUMN `roles` VARCHAR(255) NOT NULL DEFAULT ''user''',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='users' AND `column_name`='disabled') = 0,
+    'ALTER TABLE `users` ADD COLUMN `disabled` TINYINT(1) NOT NULL DEFAULT 0',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+CREATE TABLE IF NOT EXISTS `deletions` (
+    `username` VARCHAR(128) NOT NULL,
+    `stage` VARCHAR(16) NOT NULL,
+    `objects` BIGINT NOT NULL DEFAULT 0,
+    `error` TEXT NULL DEFAULT NULL,
+    `created` DATETIME NOT NULL,
+    `updated` DATETIME NOT NULL,
+    `session` VARCHAR(64) NOT NULL DEFAULT '',
+    `scope_expired_at` DATETIME NOT NULL,
+    PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS `audit` (
+    `time` DATETIME NOT NULL,
+    `event` VARCHAR(32) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `actor` VARCHAR(128) NOT NULL DEFAULT '',
+    `success` TINYINT(1) NOT NULL,
+    `request_id` VARCHAR(64) NOT NULL DEFAULT '',
+    `client_ip` VARCHAR(64) NOT NULL DEFAULT '',
+    `details` TEXT NULL DEFAULT NULL,
+    KEY (`username`, `time`),
+    KEY (`time`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
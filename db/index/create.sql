@@ -0,0 +1,34 @@
+USE `apparat.users`;
+
+CREATE TABLE IF NOT EXISTS `files` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `username` VARCHAR(128) NOT NULL,
+    `bucket` VARCHAR(32) NOT NULL,
+    `name` VARCHAR(255) NOT NULL,
+    `timestamp` DATETIME NOT NULL,
+    `size` BIGINT UNSIGNED NOT NULL,
+    `content_type` VARCHAR(128) NOT NULL DEFAULT '',
+    `media` TEXT NULL DEFAULT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `username_name` (`username`, `name`),
+    KEY `username_timestamp` (`username`, `timestamp`),
+    KEY `username_size` (`username`, `size`),
+    KEY `username_content_type` (`username`, `content_type`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS `tags` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `username` VARCHAR(128) NOT NULL,
+    `tag` VARCHAR(32) NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `username_tag` (`username`, `tag`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS `file_tags` (
+    `tag_id` BIGINT UNSIGNED NOT NULL,
+    `file_id` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`tag_id`, `file_id`),
+    KEY `file_id` (`file_id`),
+    FOREIGN KEY (`tag_id`) REFERENCES `tags` (`id`) ON DELETE CASCADE,
+    FOREIGN KEY (`file_id`) REFERENCES `files` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
@@ -0,0 +1,35 @@
+USE `apparat.users`;
+
+-- every column and key is only added if it does not exist yet, so that the script can be applied again
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='files' AND `column_name`='content_type') = 0,
+    'ALTER TABLE `files` ADD COLUMN `content_type` VARCHAR(128) NOT NULL DEFAULT ''''',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`statistics`
+        WHERE `table_schema`=DATABASE() AND `table_name`='files' AND `index_name`='username_size') = 0,
+    'ALTER TABLE `files` ADD KEY `username_size` (`username`, `size`)',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`statistics`
+        WHERE `table_schema`=DATABASE() AND `table_name`='files' AND `index_name`='username_content_type') = 0,
+    'ALTER TABLE `files` ADD KEY `username_content_type` (`username`, `content_type`)',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @ddl = IF((SELECT COUNT(*) FROM `information_schema`.`columns`
+        WHERE `table_schema`=DATABASE() AND `table_name`='files' AND `column_name`='media') = 0,
+    'ALTER TABLE `files` ADD COLUMN `media` TEXT NULL DEFAULT NULL',
+    'DO 0');
+PREPARE stmt FROM @ddl;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
@@ -9,12 +9,12 @@ import (
 	"net/http"
 )
 
-func AuthRequired(auth_url string) gin.HandlerFunc {
+func auth_required(verify func(r *http.Request) (*auth.AuthCookie, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		cookie, err := c.Request.Cookie(auth.CookieName)
+		ac, err := verify(c.Request)
 		if err != nil {
-			glog.Errorf("could not get cookie '%s': %v\n", auth.CookieName, err)
-			estr := fmt.Sprintf("could not get cookie '%s' from request, error: %v", auth.CookieName, err)
+			glog.Errorf("auth check has failed: %v\n", err)
+			estr := fmt.Sprintf("auth check has failed: %v", err)
 			common.NewErrorString(c, "auth", estr)
 			c.JSON(http.StatusForbidden, gin.H {
 				"operation": "auth",
@@ -24,10 +24,32 @@ func AuthRequired(auth_url string) gin.HandlerFunc {
 			return
 		}
 
-		ac, err := auth.CheckCookieWeb(auth_url, cookie)
-		if err != nil {
-			glog.Errorf("cookie check has failed: %v\n", err)
-			estr := fmt.Sprintf("cookie check has failed: %v", err)
+		c.Set("username", ac.Username)
+		c.Set("scopes", ac.Scopes)
+		c.Set("roles", ac.Roles)
+		c.Next()
+	}
+}
+
+func AuthRequired(verifier auth.Verifier) gin.HandlerFunc {
+	return auth_required(verifier.Verify)
+}
+
+// FreshAuthRequired does not use cached verification results, it must protect handlers which require ScopeDelete
+func FreshAuthRequired(verifier auth.Verifier) gin.HandlerFunc {
+	return auth_required(verifier.VerifyFresh)
+}
+
+// RequireScope must be used after AuthRequired(), it rejects requests whose credentials do not carry @scope
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var scopes []string
+		if s, exists := c.Get("scopes"); exists {
+			scopes, _ = s.([]string)
+		}
+
+		if !auth.HasScope(scopes, scope) {
+			estr := fmt.Sprintf("credentials do not have '%s' scope, available scopes: %v", scope, scopes)
 			common.NewErrorString(c, "auth", estr)
 			c.JSON(http.StatusForbidden, gin.H {
 				"operation": "auth",
@@ -37,8 +59,32 @@ func AuthRequired(auth_url string) gin.HandlerFunc {
 			return
 		}
 
-		c.Set("username", ac.Username)
 		c.Next()
 	}
 }
 
+// RequireRole must be used after AuthRequired(), it rejects requests of users which do not have any of @roles,
+// API tokens carry no roles and are always rejected
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user_roles []string
+		if r, exists := c.Get("roles"); exists {
+			user_roles, _ = r.([]string)
+		}
+
+		for _, role := range roles {
+			if auth.HasRole(user_roles, role) {
+				c.Next()
+				return
+			}
+		}
+
+		estr := fmt.Sprintf("one of %v roles is required, user roles: %v", roles, user_roles)
+		common.NewErrorString(c, "auth", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "auth",
+			"error": estr,
+		})
+		c.Abort()
+	}
+}
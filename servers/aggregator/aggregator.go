@@ -38,6 +38,7 @@ func main() {
 	io_addr := flag.String("io-addr", "", "address where IO server lives")
 	static_dir := flag.String("static", "", "directory for static content")
 	nulla_addr := flag.String("nulla-addr", "", "address where Nulla streaming server lives")
+	service_key := flag.String("service-key", "", "key shared with auth server, it is required to delete accounts")
 
 	flag.Parse()
 	if *addr == "" {
@@ -83,12 +84,87 @@ func main() {
 	r.POST("/login", func (c *gin.Context) {
 		auth_forwarder.Forward(c)
 	})
+	r.POST("/login/totp", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/totp/enroll", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/totp/confirm", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/totp/disable", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
 	r.POST("/signup", func (c *gin.Context) {
 		auth_forwarder.Forward(c)
 	})
 	r.POST("/update", func (c *gin.Context) {
 		auth_forwarder.Forward(c)
 	})
+	r.PATCH("/me", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/logout", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/logout_all", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/admin/users", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/admin/users/disable", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/admin/users/roles", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/admin/revoke", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/admin/lockouts", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/admin/lockouts/clear", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/admin/audit", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/admin/audit/export", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/oidc/login", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/oidc/callback", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/email/verify", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/email/verify", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/email/verify/send", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/password/reset/request", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/password/reset", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/tokens/create", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.GET("/tokens", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+	r.POST("/tokens/revoke", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
 
 	index_forwarder := &aggregator.Forwarder {
 		Addr:	*index_addr,
@@ -96,12 +172,30 @@ func main() {
 	r.POST("/index", func (c *gin.Context) {
 		index_forwarder.Forward(c)
 	})
+	r.POST("/untag", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
+	r.POST("/tag/delete", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
+	r.POST("/tag/rename", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
 	r.POST("/list", func (c *gin.Context) {
 		index_forwarder.Forward(c)
 	})
 	r.POST("/list_meta", func (c *gin.Context) {
 		index_forwarder.Forward(c)
 	})
+	r.POST("/search", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
+	r.GET("/usage", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
+	r.GET("/admin/usage/:username", func (c *gin.Context) {
+		index_forwarder.Forward(c)
+	})
 
 	nulla_forwarder := &aggregator.Forwarder {
 		Addr:	*nulla_addr,
@@ -110,11 +204,33 @@ func main() {
 		nulla_forwarder.Forward(c)
 	})
 
+	account_deleter := &aggregator.AccountDeleter {
+		AuthAddr:	*auth_addr,
+		IndexAddr:	*index_addr,
+		IOAddr:		*io_addr,
+		ServiceKey:	*service_key,
+	}
+	r.POST("/account/delete", func (c *gin.Context) {
+		account_deleter.Delete(c)
+	})
+	r.GET("/account/delete", func (c *gin.Context) {
+		auth_forwarder.Forward(c)
+	})
+
+	profile := &aggregator.Profile {
+		AuthAddr:	*auth_addr,
+		IndexAddr:	*index_addr,
+	}
+	r.GET("/me", func (c *gin.Context) {
+		profile.Get(c)
+	})
+
 	io_forwarder := &aggregator.Indexer {
 		Forwarder: aggregator.Forwarder {
 			Addr:	*io_addr,
 		},
 		IndexUrl: fmt.Sprintf("http://%s/index", *index_addr),
+		AuthAddr: *auth_addr,
 	}
 	r.POST("/upload/:key", func (c *gin.Context) {
 		io_forwarder.Forward(c)
@@ -1,17 +1,37 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/bioothod/apparat/middleware"
 	"github.com/bioothod/apparat/services/auth"
 	"github.com/bioothod/apparat/services/common"
 	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var authCtl *auth.AuthCtl
+var oidcProvider *auth.OIDCProvider
+var serviceKey string
+var oidcSuccessRedirect string
+var totpIssuer string
+var mailer auth.Mailer
+var loginLimiter *auth.Limiter
+var baseURL string
+
+const verifyTokenTTL time.Duration = 48 * time.Hour
+const resetTokenTTL time.Duration = time.Hour
+
+const defaultTokenTTL time.Duration = 30 * 24 * time.Hour
+const maxTokenTTL time.Duration = 365 * 24 * time.Hour
 
 type Mailbox struct {
 	Username		string		`form:"username" json:"username" binding:"required"`
@@ -38,6 +58,155 @@ func FromRequest(c *gin.Context) (*auth.Mailbox, error) {
 	return ambox, nil
 }
 
+func start_session(c *gin.Context, username string) error {
+	ac, err := authCtl.NewSession(username)
+	if err != nil {
+		return err
+	}
+
+	return auth.SetAuthCookie(c.Request, c.Writer, ac)
+}
+
+func check_session(c *gin.Context) (*auth.AuthCookie, error) {
+	ac, err := auth.CheckAuthCookie(c.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = authCtl.CheckSession(ac)
+	if err != nil {
+		return nil, err
+	}
+
+	// cookie signed with one of the older keys is signed again with the newest one
+	err = auth.ResignAuthCookie(c.Request, c.Writer)
+	if err != nil {
+		glog.Errorf("could not re-sign cookie of user %s: %v", ac.Username, err)
+	}
+
+	return ac, nil
+}
+
+// auth server can not use middleware.AuthRequired() since it would have to call its own /check handler,
+// instead it checks cookie and session directly
+func auth_required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ac, err := check_session(c)
+		if err != nil {
+			estr := fmt.Sprintf("cookie check has failed: %v", err)
+			common.NewErrorString(c, "auth", estr)
+			c.JSON(http.StatusForbidden, gin.H {
+				"operation": "auth",
+				"error": estr,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("username", ac.Username)
+		c.Set("auth", ac)
+		c.Set("scopes", ac.Scopes)
+		c.Set("roles", ac.Roles)
+		c.Next()
+	}
+}
+
+// service_required only lets through requests of the internal services which know the service key,
+// all requests are rejected if the key is not configured
+func service_required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.CheckServiceKey(c.Request.Header.Get(auth.ServiceKeyHeader), serviceKey) {
+			estr := "this operation is only allowed for internal services"
+			common.NewErrorString(c, "auth", estr)
+			c.JSON(http.StatusForbidden, gin.H {
+				"operation": "auth",
+				"error": estr,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// audit records security-relevant event, @err is nil if operation has succeeded
+func audit(c *gin.Context, event, username string, err error, details string) {
+	e := &auth.AuditEvent {
+		Event:		event,
+		Username:	username,
+		Success:	err == nil,
+		RequestID:	c.Request.Header.Get(middleware.XRequestHeader),
+		ClientIP:	c.ClientIP(),
+		Details:	details,
+	}
+	if err != nil {
+		if e.Details != "" {
+			e.Details += ": "
+		}
+		e.Details += err.Error()
+	}
+	if actor, ok := c.Get("username"); ok {
+		if a, _ := actor.(string); a != username {
+			e.Actor = a
+		}
+	}
+
+	authCtl.Audit(e)
+}
+
+func check_login_attempts(c *gin.Context, username string) error {
+	err := loginLimiter.Check(auth.UserLimiterKey(username))
+	if err != nil {
+		return err
+	}
+
+	return loginLimiter.Check(auth.ClientLimiterKey(c.ClientIP()))
+}
+
+func login_failed(c *gin.Context, username string) {
+	loginLimiter.Fail(auth.UserLimiterKey(username))
+	loginLimiter.Fail(auth.ClientLimiterKey(c.ClientIP()))
+}
+
+// second_factor_required replies with the second factor step if user has enabled TOTP,
+// it returns false if there is no second factor and session can be started right away
+func second_factor_required(c *gin.Context, operation, username, method string) bool {
+	totp, err := authCtl.GetTOTP(username)
+	if err != nil {
+		estr := fmt.Sprintf("could not check two-factor authentication state of user: %s, error: %v", username, err)
+		common.NewErrorString(c, operation, estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": operation,
+			"error": estr,
+		})
+		return true
+	}
+
+	if !totp.Enabled {
+		return false
+	}
+
+	// session cookie will only be issued by /login/totp handler after the second factor has been checked
+	err = auth.SetPendingLogin(c.Request, c.Writer, username)
+	if err != nil {
+		estr := fmt.Sprintf("could not set cookie: %v", err)
+		common.NewErrorString(c, operation, estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": operation,
+			"error": estr,
+		})
+		return true
+	}
+
+	audit(c, auth.AuditLogin, username, nil, method + " accepted, waiting for second factor")
+	c.JSON(http.StatusOK, gin.H {
+		"operation": operation,
+		"second_factor": "totp",
+	})
+	return true
+}
+
 func user_signup(c *gin.Context) {
 	mbox, err := FromRequest(c)
 	if err != nil {
@@ -52,6 +221,8 @@ func user_signup(c *gin.Context) {
 
 	err = authCtl.NewUser(mbox)
 	if err != nil {
+		audit(c, auth.AuditSignup, mbox.Username, err, "")
+
 		estr := fmt.Sprintf("could not create new user: %v", err)
 		common.NewErrorString(c, "signup", estr)
 		c.JSON(http.StatusBadRequest, gin.H {
@@ -61,7 +232,7 @@ func user_signup(c *gin.Context) {
 		return
 	}
 
-	err = auth.SetAuthCookie(c.Request, c.Writer, auth.NewAuthCookie(mbox.Username))
+	err = start_session(c, mbox.Username)
 	if err != nil {
 		estr := fmt.Sprintf("could not set cookie: %v", err)
 		common.NewErrorString(c, "signup", estr)
@@ -72,6 +243,7 @@ func user_signup(c *gin.Context) {
 		return
 	}
 
+	audit(c, auth.AuditSignup, mbox.Username, nil, "")
 	mbox.Password = ""
 	c.JSON(http.StatusOK, gin.H {
 		"operation": "signup",
@@ -91,8 +263,24 @@ func user_login(c *gin.Context) {
 		return
 	}
 
-	err = authCtl.GetUser(mbox)
+	err = check_login_attempts(c, mbox.Username)
+	if err != nil {
+		audit(c, auth.AuditLogin, mbox.Username, err, "refused")
+
+		estr := fmt.Sprintf("login refused, user: %s, client: %s, error: %v", mbox.Username, c.ClientIP(), err)
+		common.NewErrorString(c, "login", estr)
+		c.JSON(http.StatusTooManyRequests, gin.H {
+			"operation": "login",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.Login(mbox)
 	if err != nil {
+		login_failed(c, mbox.Username)
+		audit(c, auth.AuditLogin, mbox.Username, err, "password")
+
 		estr := fmt.Sprintf("could not check user: %s, error: %v", mbox.Username, err)
 		common.NewErrorString(c, "login", estr)
 		c.JSON(http.StatusBadRequest, gin.H {
@@ -102,7 +290,13 @@ func user_login(c *gin.Context) {
 		return
 	}
 
-	err = auth.SetAuthCookie(c.Request, c.Writer, auth.NewAuthCookie(mbox.Username))
+	if second_factor_required(c, "login", mbox.Username, "password") {
+		return
+	}
+
+	loginLimiter.Success(auth.UserLimiterKey(mbox.Username))
+
+	err = start_session(c, mbox.Username)
 	if err != nil {
 		estr := fmt.Sprintf("could not set cookie: %v", err)
 		common.NewErrorString(c, "login", estr)
@@ -113,6 +307,7 @@ func user_login(c *gin.Context) {
 		return
 	}
 
+	audit(c, auth.AuditLogin, mbox.Username, nil, "password")
 	mbox.Password = ""
 	c.JSON(http.StatusOK, gin.H {
 		"operation": "login",
@@ -120,119 +315,1510 @@ func user_login(c *gin.Context) {
 	})
 }
 
-func user_update(c *gin.Context) {
-	mbox, err := FromRequest(c)
+type CodeRequest struct {
+	Code			string		`form:"code" json:"code" binding:"required"`
+}
+
+func user_login_totp(c *gin.Context) {
+	username, err := auth.CheckPendingLogin(c.Request)
 	if err != nil {
-		estr := fmt.Sprintf("could not parse mailbox: %v", err)
-		common.NewErrorString(c, "update", estr)
-		c.JSON(http.StatusBadRequest, gin.H {
-			"operation": "update",
+		estr := fmt.Sprintf("could not check pending login: %v", err)
+		common.NewErrorString(c, "login_totp", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "login_totp",
 			"error": estr,
 		})
 		return
 	}
 
-	err = authCtl.UpdateUser(mbox)
+	var req CodeRequest
+	err = c.Bind(&req)
 	if err != nil {
-		estr := fmt.Sprintf("could not update user: %s, error: %v", mbox.Username, err)
-		common.NewErrorString(c, "update", estr)
+		estr := fmt.Sprintf("invalid second factor request: %v", err)
+		common.NewErrorString(c, "login_totp", estr)
 		c.JSON(http.StatusBadRequest, gin.H {
-			"operation": "update",
+			"operation": "login_totp",
 			"error": estr,
 		})
 		return
 	}
 
-	mbox.Password = ""
+	err = check_login_attempts(c, username)
+	if err != nil {
+		audit(c, auth.AuditLogin, username, err, "refused")
+
+		estr := fmt.Sprintf("login refused, user: %s, client: %s, error: %v", username, c.ClientIP(), err)
+		common.NewErrorString(c, "login_totp", estr)
+		c.JSON(http.StatusTooManyRequests, gin.H {
+			"operation": "login_totp",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.CheckSecondFactor(username, req.Code)
+	if err != nil {
+		login_failed(c, username)
+		audit(c, auth.AuditLogin, username, err, "second factor")
+
+		estr := fmt.Sprintf("could not check second factor of user: %s, error: %v", username, err)
+		common.NewErrorString(c, "login_totp", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "login_totp",
+			"error": estr,
+		})
+		return
+	}
+
+	mbox := &auth.Mailbox {
+		Username:	username,
+	}
+	err = authCtl.LookupUser(mbox)
+	if err != nil {
+		estr := fmt.Sprintf("could not read user: %s, error: %v", username, err)
+		common.NewErrorString(c, "login_totp", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "login_totp",
+			"error": estr,
+		})
+		return
+	}
+
+	auth.ClearPendingLogin(c.Request, c.Writer)
+	loginLimiter.Success(auth.UserLimiterKey(username))
+
+	err = start_session(c, username)
+	if err != nil {
+		estr := fmt.Sprintf("could not set cookie: %v", err)
+		common.NewErrorString(c, "login_totp", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "login_totp",
+			"error": estr,
+		})
+		return
+	}
+
+	audit(c, auth.AuditLogin, username, nil, "second factor")
 	c.JSON(http.StatusOK, gin.H {
-		"operation": "update",
+		"operation": "login_totp",
 		"mailbox": mbox,
 	})
 }
 
-func check_cookie(c *gin.Context) {
-	ac, err := auth.CheckAuthCookie(c.Request)
+func totp_enroll(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	secret, err := authCtl.EnrollTOTP(username)
 	if err != nil {
-		common.NewError(c, "check", err)
-		c.JSON(http.StatusForbidden, gin.H {
-			"operation": "check",
-			"error": err.Error(),
+		estr := fmt.Sprintf("could not start two-factor authentication enrollment for user: %s, error: %v", username, err)
+		common.NewErrorString(c, "totp_enroll", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "totp_enroll",
+			"error": estr,
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H {
-		"operation": "check",
-		"auth": ac,
+		"operation": "totp_enroll",
+		"secret": secret,
+		"url": auth.TOTPURL(totpIssuer, username, secret),
 	})
 }
 
-func main() {
-	addr := flag.String("addr", "", "address to listen auth server at")
-	dbparams := flag.String("db", "", "mysql database parameters:\n" +
-		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
-		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
-		"	user:password@/dbname\n" +
-		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
-	cookie_auth := flag.String("cookie-auth", "", "key to authenticate cookies")
-	cookie_encrypt := flag.String("cookie-encrypt", "", "key to encrypt cookies")
-	cookie_path := flag.String("cookie-path", "/", "cookie path")
+func totp_confirm(c *gin.Context) {
+	username := c.MustGet("username").(string)
 
-	flag.Parse()
-	if *addr == "" {
-		log.Fatalf("You must provide address where auth server will listen for incoming connections")
+	var req CodeRequest
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid confirmation request: %v", err)
+		common.NewErrorString(c, "totp_confirm", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "totp_confirm",
+			"error": estr,
+		})
+		return
 	}
-	if *dbparams == "" {
-		log.Fatalf("You must provide mysql auth database parameters")
+
+	codes, err := authCtl.ConfirmTOTP(username, req.Code)
+	if err != nil {
+		estr := fmt.Sprintf("could not enable two-factor authentication for user: %s, error: %v", username, err)
+		common.NewErrorString(c, "totp_confirm", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "totp_confirm",
+			"error": estr,
+		})
+		return
 	}
-	if *cookie_auth == "" {
-		log.Fatalf("you must provide auth key")
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "totp_confirm",
+		"recovery_codes": codes,
+	})
+}
+
+func totp_disable(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	type DisableRequest struct {
+		Password		string		`form:"password" json:"password" binding:"required"`
+		Code			string		`form:"code" json:"code" binding:"required"`
 	}
+	var req DisableRequest
 
-	var err error
-	authCtl, err = auth.NewAuthCtl("mysql", *dbparams)
+	err := c.Bind(&req)
 	if err != nil {
-		log.Fatalf("could not connect to MySQL database '%s': %v", *dbparams, err)
+		estr := fmt.Sprintf("invalid disable request: %v", err)
+		common.NewErrorString(c, "totp_disable", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "totp_disable",
+			"error": estr,
+		})
+		return
 	}
-	defer authCtl.Close()
 
-	var cookie_keys [][]byte
-	cookie_keys = make([][]byte, 0)
-	cookie_keys = append(cookie_keys, []byte(*cookie_auth))
+	mbox := &auth.Mailbox {
+		Username:	username,
+		Password:	req.Password,
+	}
+	err = authCtl.Login(mbox)
+	if err == nil {
+		err = authCtl.CheckSecondFactor(username, req.Code)
+	}
+	if err != nil {
+		estr := fmt.Sprintf("could not check credentials of user: %s, error: %v", username, err)
+		common.NewErrorString(c, "totp_disable", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "totp_disable",
+			"error": estr,
+		})
+		return
+	}
 
-	if *cookie_encrypt != "" {
-		cookie_keys = append(cookie_keys, []byte(*cookie_encrypt))
+	err = authCtl.DisableTOTP(username)
+	audit(c, auth.AuditTOTP, username, err, "disable")
+	if err != nil {
+		estr := fmt.Sprintf("could not disable two-factor authentication for user: %s, error: %v", username, err)
+		common.NewErrorString(c, "totp_disable", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "totp_disable",
+			"error": estr,
+		})
+		return
 	}
 
-	auth.InitCookieStore(cookie_keys, *cookie_path)
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "totp_disable",
+	})
+}
 
-	r := gin.New()
-	r.Use(middleware.XTrace())
-	r.Use(middleware.Logger())
-	r.Use(gin.Recovery())
-	r.Use(middleware.ClearGorillaContext())
-	r.Use(middleware.CORS())
+// UpdateRequest is a partial update, only fields present in request are changed
+type UpdateRequest struct {
+	CurrentPassword		string		`form:"current_password" json:"current_password"`
+	Password		*string		`form:"password" json:"password"`
+	Realname		*string		`form:"realname" json:"realname"`
+	Email			*string		`form:"email" json:"email"`
+}
 
-	r.GET("/ping", func(c *gin.Context) {
-		err := authCtl.Ping()
+// update_user always operates on the authenticated user, username from request body is never used
+func update_user(c *gin.Context, operation string) {
+	ac := c.MustGet("auth").(*auth.AuthCookie)
+
+	var req UpdateRequest
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid update request: %v", err)
+		common.NewErrorString(c, operation, estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": operation,
+			"error": estr,
+		})
+		return
+	}
+
+	mbox := &auth.Mailbox {
+		Username:	ac.Username,
+	}
+	err = authCtl.LookupUser(mbox)
+	if err != nil {
+		estr := fmt.Sprintf("could not read user: %s, error: %v", ac.Username, err)
+		common.NewErrorString(c, operation, estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": operation,
+			"error": estr,
+		})
+		return
+	}
+
+	if req.Password != nil {
+		err = authCtl.CanChangePassword(ac.Username)
 		if err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H {
-				"message": err,
+			estr := fmt.Sprintf("could not change password: %v", err)
+			common.NewErrorString(c, operation, estr)
+			c.JSON(http.StatusForbidden, gin.H {
+				"operation": operation,
+				"error": estr,
 			})
 			return
 		}
+	}
 
-		c.JSON(http.StatusOK, gin.H {
-			"message": "Ok",
-		})
-	})
+	credentials_changed := (req.Password != nil) || (req.Email != nil && *req.Email != mbox.Email)
+	if credentials_changed {
+		err = check_login_attempts(c, ac.Username)
+		if err != nil {
+			estr := fmt.Sprintf("update refused, user: %s, client: %s, error: %v", ac.Username, c.ClientIP(), err)
+			common.NewErrorString(c, operation, estr)
+			c.JSON(http.StatusTooManyRequests, gin.H {
+				"operation": operation,
+				"error": estr,
+			})
+			return
+		}
 
-	r.POST("/login", user_login)
-	r.POST("/signup", user_signup)
-	r.POST("/check", check_cookie)
+		check := &auth.Mailbox {
+			Username:	ac.Username,
+			Password:	req.CurrentPassword,
+		}
+		err = authCtl.Login(check)
+		if err != nil {
+			login_failed(c, ac.Username)
+			audit(c, auth.AuditUpdate, ac.Username, err, "current password")
 
-	authorized := r.Group("/", middleware.AuthRequired(*addr))
-	authorized.POST("/update", user_update)
+			estr := fmt.Sprintf("current password is required to change password or email, user: %s, error: %v", ac.Username, err)
+			common.NewErrorString(c, operation, estr)
+			c.JSON(http.StatusForbidden, gin.H {
+				"operation": operation,
+				"error": estr,
+			})
+			return
+		}
+	}
+
+	if req.Password != nil {
+		if *req.Password == "" {
+			estr := fmt.Sprintf("new password must not be empty, user: %s", ac.Username)
+			common.NewErrorString(c, operation, estr)
+			c.JSON(http.StatusBadRequest, gin.H {
+				"operation": operation,
+				"error": estr,
+			})
+			return
+		}
+
+		mbox.Password = *req.Password
+	}
+	if req.Realname != nil {
+		mbox.Realname = *req.Realname
+	}
+	if req.Email != nil {
+		mbox.Email = *req.Email
+	}
+
+	changed := make([]string, 0)
+	if req.Password != nil {
+		changed = append(changed, "password")
+	}
+	if req.Realname != nil {
+		changed = append(changed, "realname")
+	}
+	if req.Email != nil {
+		changed = append(changed, "email")
+	}
+
+	err = authCtl.UpdateUser(mbox)
+	audit(c, auth.AuditUpdate, mbox.Username, err, strings.Join(changed, ","))
+	if err != nil {
+		estr := fmt.Sprintf("could not update user: %s, error: %v", mbox.Username, err)
+		common.NewErrorString(c, operation, estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": operation,
+			"error": estr,
+		})
+		return
+	}
+
+	if credentials_changed {
+		// whoever else has been logged in with old credentials must login again, current session is kept
+		err = authCtl.RevokeUserSessions(mbox.Username, ac.Token)
+		if err != nil {
+			estr := fmt.Sprintf("user has been updated, but other sessions could not be revoked, user: %s, error: %v", mbox.Username, err)
+			common.NewErrorString(c, operation, estr)
+			c.JSON(http.StatusServiceUnavailable, gin.H {
+				"operation": operation,
+				"error": estr,
+			})
+			return
+		}
+	}
+
+	mbox.Password = ""
+	c.JSON(http.StatusOK, gin.H {
+		"operation": operation,
+		"mailbox": mbox,
+	})
+}
+
+func user_update(c *gin.Context) {
+	update_user(c, "update")
+}
+
+func user_me(c *gin.Context) {
+	ac := c.MustGet("auth").(*auth.AuthCookie)
+
+	profile, err := authCtl.Profile(ac)
+	if err != nil {
+		estr := fmt.Sprintf("could not read profile of user %s: %v", ac.Username, err)
+		common.NewErrorString(c, "me", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "me",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "me",
+		"profile": profile,
+	})
+}
+
+func user_me_update(c *gin.Context) {
+	update_user(c, "me")
+}
+
+func user_logout(c *gin.Context) {
+	ac := c.MustGet("auth").(*auth.AuthCookie)
+
+	err := authCtl.RevokeSession(ac.Token)
+	audit(c, auth.AuditLogout, ac.Username, err, "")
+	if err != nil {
+		estr := fmt.Sprintf("could not logout user: %s, error: %v", ac.Username, err)
+		common.NewErrorString(c, "logout", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "logout",
+			"error": estr,
+		})
+		return
+	}
+
+	auth.ClearAuthCookie(c.Request, c.Writer)
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "logout",
+	})
+}
+
+func user_logout_all(c *gin.Context) {
+	ac := c.MustGet("auth").(*auth.AuthCookie)
+
+	err := authCtl.RevokeUserSessions(ac.Username, "")
+	audit(c, auth.AuditLogout, ac.Username, err, "all sessions")
+	if err != nil {
+		estr := fmt.Sprintf("could not logout user: %s, error: %v", ac.Username, err)
+		common.NewErrorString(c, "logout_all", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "logout_all",
+			"error": estr,
+		})
+		return
+	}
+
+	auth.ClearAuthCookie(c.Request, c.Writer)
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "logout_all",
+	})
+}
+
+// account_delete starts account deletion or returns existing job so that it can be resumed,
+// user has to enter password (and the second factor if enabled) again
+func account_delete(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	type DeleteRequest struct {
+		Password		string		`form:"password" json:"password" binding:"required"`
+		Code			string		`form:"code" json:"code"`
+	}
+	var req DeleteRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid account deletion request: %v", err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	err = check_login_attempts(c, username)
+	if err != nil {
+		estr := fmt.Sprintf("account deletion refused, user: %s, client: %s, error: %v", username, c.ClientIP(), err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusTooManyRequests, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	mbox := &auth.Mailbox {
+		Username:	username,
+		Password:	req.Password,
+	}
+	err = authCtl.Login(mbox)
+	if err == nil {
+		var totp *auth.TOTPState
+		totp, err = authCtl.GetTOTP(username)
+		if err == nil && totp.Enabled {
+			err = authCtl.CheckSecondFactor(username, req.Code)
+		}
+	}
+	if err != nil {
+		login_failed(c, username)
+		audit(c, auth.AuditAccountDelete, username, err, "credentials")
+
+		estr := fmt.Sprintf("could not check credentials of user: %s, error: %v", username, err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	ac := c.MustGet("auth").(*auth.AuthCookie)
+	d, err := authCtl.StartDeletion(username, ac.Token)
+	audit(c, auth.AuditAccountDelete, username, err, "start")
+	if err != nil {
+		estr := fmt.Sprintf("could not start account deletion, user: %s, error: %v", username, err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_delete",
+		"deletion": d,
+	})
+}
+
+func account_delete_status(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	d, err := authCtl.GetDeletion(username)
+	if err != nil {
+		estr := fmt.Sprintf("could not read account deletion state, user: %s, error: %v", username, err)
+		common.NewErrorString(c, "account_delete_status", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "account_delete_status",
+			"error": estr,
+		})
+		return
+	}
+	if d == nil {
+		estr := fmt.Sprintf("account %s is not being deleted", username)
+		common.NewErrorString(c, "account_delete_status", estr)
+		c.JSON(http.StatusNotFound, gin.H {
+			"operation": "account_delete_status",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_delete_status",
+		"deletion": d,
+	})
+}
+
+func account_delete_progress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	type ProgressRequest struct {
+		Stage			string		`form:"stage" json:"stage" binding:"required"`
+		Objects			uint64		`form:"objects" json:"objects"`
+		Error			string		`form:"error" json:"error"`
+	}
+	var req ProgressRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid account deletion progress request: %v", err)
+		common.NewErrorString(c, "account_delete_progress", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "account_delete_progress",
+			"error": estr,
+		})
+		return
+	}
+
+	d, err := authCtl.UpdateDeletion(username, req.Stage, req.Objects, req.Error)
+	if err != nil {
+		estr := fmt.Sprintf("could not update account deletion state, user: %s, error: %v", username, err)
+		common.NewErrorString(c, "account_delete_progress", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "account_delete_progress",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_delete_progress",
+		"deletion": d,
+	})
+}
+
+func account_delete_finish(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	err := authCtl.FinishDeletion(username)
+	audit(c, auth.AuditAccountDelete, username, err, "account removed")
+	if err != nil {
+		estr := fmt.Sprintf("could not remove account, user: %s, error: %v", username, err)
+		common.NewErrorString(c, "account_delete_finish", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "account_delete_finish",
+			"error": estr,
+		})
+		return
+	}
+
+	auth.ClearAuthCookie(c.Request, c.Writer)
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_delete_finish",
+	})
+}
+
+func admin_revoke(c *gin.Context) {
+	type RevokeRequest struct {
+		Username		string		`form:"username" json:"username" binding:"required"`
+	}
+	var req RevokeRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid revoke request: %v", err)
+		common.NewErrorString(c, "revoke", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "revoke",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.RevokeUserSessions(req.Username, "")
+	if err != nil {
+		estr := fmt.Sprintf("could not revoke sessions of user: %s, error: %v", req.Username, err)
+		common.NewErrorString(c, "revoke", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "revoke",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "revoke",
+		"username": req.Username,
+	})
+}
+
+func token_create(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	type TokenRequest struct {
+		Name			string		`form:"name" json:"name" binding:"required"`
+		Scopes			[]string	`form:"scopes" json:"scopes" binding:"required"`
+		TTL			string		`form:"ttl" json:"ttl"`
+	}
+	var req TokenRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid token request: %v", err)
+		common.NewErrorString(c, "token_create", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "token_create",
+			"error": estr,
+		})
+		return
+	}
+
+	ttl := defaultTokenTTL
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || ttl > maxTokenTTL {
+			estr := fmt.Sprintf("invalid token ttl '%s', must be positive duration not exceeding %s", req.TTL, maxTokenTTL)
+			common.NewErrorString(c, "token_create", estr)
+			c.JSON(http.StatusBadRequest, gin.H {
+				"operation": "token_create",
+				"error": estr,
+			})
+			return
+		}
+	}
+
+	t, token, err := authCtl.NewToken(username, req.Name, req.Scopes, ttl)
+	if err != nil {
+		audit(c, auth.AuditTokenCreate, username, err, req.Name)
+
+		estr := fmt.Sprintf("could not create token for user: %s, error: %v", username, err)
+		common.NewErrorString(c, "token_create", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "token_create",
+			"error": estr,
+		})
+		return
+	}
+
+	audit(c, auth.AuditTokenCreate, username, nil, fmt.Sprintf("id: %s, name: %s, scopes: %v", t.ID, t.Name, t.Scopes))
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "token_create",
+		"token": t,
+		"secret": token,
+	})
+}
+
+func token_list(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	tokens, err := authCtl.ListTokens(username)
+	if err != nil {
+		estr := fmt.Sprintf("could not list tokens of user: %s, error: %v", username, err)
+		common.NewErrorString(c, "token_list", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "token_list",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "token_list",
+		"tokens": tokens,
+	})
+}
+
+func token_revoke(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	type RevokeRequest struct {
+		ID			string		`form:"id" json:"id" binding:"required"`
+	}
+	var req RevokeRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid token revoke request: %v", err)
+		common.NewErrorString(c, "token_revoke", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "token_revoke",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.RevokeToken(username, req.ID)
+	audit(c, auth.AuditTokenRevoke, username, err, req.ID)
+	if err != nil {
+		estr := fmt.Sprintf("could not revoke token: %v", err)
+		common.NewErrorString(c, "token_revoke", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "token_revoke",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "token_revoke",
+		"id": req.ID,
+	})
+}
+
+func oidc_login(c *gin.Context) {
+	url, err := oidcProvider.StartLogin(c.Request, c.Writer)
+	if err != nil {
+		estr := fmt.Sprintf("could not start OIDC login: %v", err)
+		common.NewErrorString(c, "oidc_login", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "oidc_login",
+			"error": estr,
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, url)
+}
+
+func oidc_callback(c *gin.Context) {
+	id, err := oidcProvider.FinishLogin(c.Request, c.Writer)
+	if err != nil {
+		estr := fmt.Sprintf("could not finish OIDC login: %v", err)
+		common.NewErrorString(c, "oidc_callback", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "oidc_callback",
+			"error": estr,
+		})
+		return
+	}
+
+	mbox, err := authCtl.ExternalUser(id)
+	if err != nil {
+		audit(c, auth.AuditLogin, "", err, fmt.Sprintf("identity %s/%s", id.Provider, id.Subject))
+
+		estr := fmt.Sprintf("could not get local user for identity %s/%s: %v", id.Provider, id.Subject, err)
+		common.NewErrorString(c, "oidc_callback", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "oidc_callback",
+			"error": estr,
+		})
+		return
+	}
+
+	identity := fmt.Sprintf("identity %s/%s", id.Provider, id.Subject)
+	if second_factor_required(c, "oidc_callback", mbox.Username, identity) {
+		return
+	}
+
+	err = start_session(c, mbox.Username)
+	if err != nil {
+		estr := fmt.Sprintf("could not set cookie: %v", err)
+		common.NewErrorString(c, "oidc_callback", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "oidc_callback",
+			"error": estr,
+		})
+		return
+	}
+
+	audit(c, auth.AuditLogin, mbox.Username, nil, identity)
+	c.Redirect(http.StatusFound, oidcSuccessRedirect)
+}
+
+func email_verify_send(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	mbox := &auth.Mailbox {
+		Username:	username,
+	}
+	err := authCtl.LookupUser(mbox)
+	if err == nil && mbox.Email == "" {
+		err = fmt.Errorf("user does not have email")
+	}
+	if err != nil {
+		estr := fmt.Sprintf("could not read email of user: %s, error: %v", username, err)
+		common.NewErrorString(c, "email_verify_send", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "email_verify_send",
+			"error": estr,
+		})
+		return
+	}
+
+	token, err := authCtl.NewEmailToken(username, auth.PurposeVerify, mbox.Email, verifyTokenTTL)
+	if err == nil {
+		err = mailer.Send(mbox.Email, "Verify your email address",
+			fmt.Sprintf("Follow this link to verify your email address:\n%s/email/verify?token=%s\n",
+				baseURL, url.QueryEscape(token)))
+	}
+	if err != nil {
+		estr := fmt.Sprintf("could not send verification email to user: %s, error: %v", username, err)
+		common.NewErrorString(c, "email_verify_send", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "email_verify_send",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "email_verify_send",
+	})
+}
+
+type EmailTokenRequest struct {
+	Token			string		`form:"token" json:"token" binding:"required"`
+}
+
+func email_verify(c *gin.Context) {
+	var req EmailTokenRequest
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid verification request: %v", err)
+		common.NewErrorString(c, "email_verify", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "email_verify",
+			"error": estr,
+		})
+		return
+	}
+
+	et, err := authCtl.UseEmailToken(req.Token, auth.PurposeVerify)
+	if err == nil {
+		err = authCtl.VerifyEmail(et.Username, et.Email)
+	}
+	if err != nil {
+		estr := fmt.Sprintf("could not verify email: %v", err)
+		common.NewErrorString(c, "email_verify", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "email_verify",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "email_verify",
+		"username": et.Username,
+	})
+}
+
+func password_reset_request(c *gin.Context) {
+	type ResetRequest struct {
+		Username		string		`form:"username" json:"username" binding:"required"`
+	}
+	var req ResetRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid password reset request: %v", err)
+		common.NewErrorString(c, "password_reset_request", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "password_reset_request",
+			"error": estr,
+		})
+		return
+	}
+
+	// reply is always the same, so that it can not be used to find out which users exist
+	mbox := &auth.Mailbox {
+		Username:	req.Username,
+	}
+	err = authCtl.LookupUser(mbox)
+	if err == nil && mbox.Email != "" {
+		var token string
+		token, err = authCtl.NewEmailToken(mbox.Username, auth.PurposeReset, mbox.Email, resetTokenTTL)
+		if err == nil {
+			err = mailer.Send(mbox.Email, "Password reset",
+				fmt.Sprintf("Follow this link to set new password:\n%s/password/reset?token=%s\n" +
+					"If you did not request password reset, ignore this message.\n",
+					baseURL, url.QueryEscape(token)))
+		}
+	}
+	if err != nil {
+		common.NewErrorString(c, "password_reset_request", fmt.Sprintf("user: %s, error: %v", req.Username, err))
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "password_reset_request",
+	})
+}
+
+func password_reset(c *gin.Context) {
+	type ResetRequest struct {
+		Token			string		`form:"token" json:"token" binding:"required"`
+		Password		string		`form:"password" json:"password" binding:"required"`
+	}
+	var req ResetRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid password reset request: %v", err)
+		common.NewErrorString(c, "password_reset", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "password_reset",
+			"error": estr,
+		})
+		return
+	}
+
+	et, err := authCtl.UseEmailToken(req.Token, auth.PurposeReset)
+	if err != nil {
+		audit(c, auth.AuditPasswordReset, "", err, "")
+
+		estr := fmt.Sprintf("could not reset password: %v", err)
+		common.NewErrorString(c, "password_reset", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "password_reset",
+			"error": estr,
+		})
+		return
+	}
+
+	mbox := &auth.Mailbox {
+		Username:	et.Username,
+	}
+	err = authCtl.LookupUser(mbox)
+	if err == nil && mbox.Email != et.Email {
+		// link has been sent to the address which does not belong to this account anymore
+		err = fmt.Errorf("email of user %s has been changed", et.Username)
+		audit(c, auth.AuditPasswordReset, et.Username, err, "")
+
+		estr := fmt.Sprintf("could not reset password: %v", err)
+		common.NewErrorString(c, "password_reset", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "password_reset",
+			"error": estr,
+		})
+		return
+	}
+	if err == nil {
+		err = authCtl.CanChangePassword(mbox.Username)
+		if err != nil {
+			audit(c, auth.AuditPasswordReset, et.Username, err, "")
+
+			estr := fmt.Sprintf("could not reset password: %v", err)
+			common.NewErrorString(c, "password_reset", estr)
+			c.JSON(http.StatusForbidden, gin.H {
+				"operation": "password_reset",
+				"error": estr,
+			})
+			return
+		}
+	}
+	if err == nil {
+		mbox.Password = req.Password
+		err = authCtl.UpdateUser(mbox)
+	}
+	if err == nil {
+		err = authCtl.RevokeUserSessions(mbox.Username, "")
+	}
+	audit(c, auth.AuditPasswordReset, et.Username, err, "")
+	if err != nil {
+		estr := fmt.Sprintf("could not reset password of user: %s, error: %v", et.Username, err)
+		common.NewErrorString(c, "password_reset", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "password_reset",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "password_reset",
+		"username": mbox.Username,
+	})
+}
+
+func admin_users(c *gin.Context) {
+	users, err := authCtl.ListUsers()
+	if err != nil {
+		estr := fmt.Sprintf("could not list users: %v", err)
+		common.NewErrorString(c, "users", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "users",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "users",
+		"users": users,
+	})
+}
+
+func admin_users_disable(c *gin.Context) {
+	type DisableRequest struct {
+		Username		string		`form:"username" json:"username" binding:"required"`
+		Disabled		bool		`form:"disabled" json:"disabled"`
+	}
+	var req DisableRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid disable request: %v", err)
+		common.NewErrorString(c, "users_disable", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "users_disable",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.SetDisabled(req.Username, req.Disabled)
+	audit(c, auth.AuditDisable, req.Username, err, fmt.Sprintf("disabled: %v", req.Disabled))
+	if err != nil {
+		estr := fmt.Sprintf("could not change account state of user: %s, error: %v", req.Username, err)
+		common.NewErrorString(c, "users_disable", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "users_disable",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "users_disable",
+		"username": req.Username,
+		"disabled": req.Disabled,
+	})
+}
+
+func admin_users_roles(c *gin.Context) {
+	type RolesRequest struct {
+		Username		string		`form:"username" json:"username" binding:"required"`
+		Roles			[]string	`form:"roles" json:"roles" binding:"required"`
+	}
+	var req RolesRequest
+
+	err := c.Bind(&req)
+	if err != nil {
+		estr := fmt.Sprintf("invalid roles request: %v", err)
+		common.NewErrorString(c, "users_roles", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "users_roles",
+			"error": estr,
+		})
+		return
+	}
+
+	err = authCtl.SetRoles(req.Username, req.Roles)
+	audit(c, auth.AuditRoles, req.Username, err, strings.Join(req.Roles, ","))
+	if err != nil {
+		estr := fmt.Sprintf("could not set roles of user: %s, error: %v", req.Username, err)
+		common.NewErrorString(c, "users_roles", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "users_roles",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "users_roles",
+		"username": req.Username,
+		"roles": req.Roles,
+	})
+}
+
+func audit_query(c *gin.Context) (*auth.AuditQuery, error) {
+	q := &auth.AuditQuery {
+		Username:	c.Query("username"),
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'since' time '%s', must be RFC3339: %v", since, err)
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		q.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'until' time '%s', must be RFC3339: %v", until, err)
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit '%s': %v", limit, err)
+		}
+	}
+
+	return q, nil
+}
+
+func admin_audit(c *gin.Context) {
+	q, err := audit_query(c)
+	if err != nil {
+		estr := fmt.Sprintf("invalid audit query: %v", err)
+		common.NewErrorString(c, "audit", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "audit",
+			"error": estr,
+		})
+		return
+	}
+
+	events, err := authCtl.ListAudit(q)
+	if err != nil {
+		estr := fmt.Sprintf("could not read audit log: %v", err)
+		common.NewErrorString(c, "audit", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "audit",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "audit",
+		"events": events,
+	})
+}
+
+// admin_audit_export writes audit events as JSON lines, one event per line
+func admin_audit_export(c *gin.Context) {
+	q, err := audit_query(c)
+	if err != nil {
+		estr := fmt.Sprintf("invalid audit query: %v", err)
+		common.NewErrorString(c, "audit_export", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "audit_export",
+			"error": estr,
+		})
+		return
+	}
+
+	events, err := authCtl.ListAudit(q)
+	if err != nil {
+		estr := fmt.Sprintf("could not read audit log: %v", err)
+		common.NewErrorString(c, "audit_export", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "audit_export",
+			"error": estr,
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", "attachment; filename=audit.jsonl")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for i := range events {
+		err = enc.Encode(&events[i])
+		if err != nil {
+			glog.Errorf("could not write audit export: %v", err)
+			return
+		}
+	}
+}
+
+func admin_lockouts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "lockouts",
+		"lockouts": loginLimiter.Lockouts(),
+	})
+}
+
+func admin_lockouts_clear(c *gin.Context) {
+	type ClearRequest struct {
+		Username		string		`form:"username" json:"username"`
+		Client			string		`form:"client" json:"client"`
+	}
+	var req ClearRequest
+
+	err := c.Bind(&req)
+	if err == nil && req.Username == "" && req.Client == "" {
+		err = fmt.Errorf("either username or client address must be specified")
+	}
+	if err != nil {
+		estr := fmt.Sprintf("invalid lockout clear request: %v", err)
+		common.NewErrorString(c, "lockouts_clear", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "lockouts_clear",
+			"error": estr,
+		})
+		return
+	}
+
+	cleared := make([]string, 0)
+	if req.Username != "" && loginLimiter.Clear(auth.UserLimiterKey(req.Username)) {
+		cleared = append(cleared, auth.UserLimiterKey(req.Username))
+	}
+	if req.Client != "" && loginLimiter.Clear(auth.ClientLimiterKey(req.Client)) {
+		cleared = append(cleared, auth.ClientLimiterKey(req.Client))
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "lockouts_clear",
+		"cleared": cleared,
+	})
+}
+
+func check_cookie(c *gin.Context) {
+	var ac *auth.AuthCookie
+	var err error
+
+	if token := auth.BearerToken(c.Request); token != "" {
+		ac, err = authCtl.CheckToken(token)
+	} else {
+		ac, err = check_session(c)
+	}
+	if err != nil {
+		common.NewError(c, "check", err)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "check",
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "check",
+		"auth": ac,
+	})
+}
+
+type sslice []string
+func (sl *sslice) String() string {
+	return fmt.Sprintf("%s", *sl)
+}
+func (sl *sslice) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+func main() {
+	var admin_names sslice
+	flag.Var(&admin_names, "admin", "username which is granted admin role at startup, can be specified multiple times")
+
+	addr := flag.String("addr", "", "address to listen auth server at")
+	store_type := flag.String("store", "mysql", "user store backend: 'mysql', 'sqlite3' or 'memory', the latter loses all data on restart")
+	dbparams := flag.String("db", "", "database parameters, path to the database file for sqlite3, for mysql:\n" +
+		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
+		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
+		"	user:password@/dbname\n" +
+		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
+	cookie_auth := flag.String("cookie-auth", "", "key to authenticate cookies")
+	cookie_encrypt := flag.String("cookie-encrypt", "", "key to encrypt cookies")
+	cookie_keyring := flag.String("cookie-keyring", "", "file with cookie keys, one 'auth-key [encrypt-key]' pair per line, " +
+		"the first one signs new cookies, the rest are still accepted, overrides -cookie-auth and -cookie-encrypt, reloaded on SIGHUP")
+	cookie_path := flag.String("cookie-path", "/", "cookie path")
+	cookie_domain := flag.String("cookie-domain", "", "cookie domain, like 'example.com' to share cookie with subdomains, host-only cookie is used if empty")
+	cookie_secure := flag.Bool("cookie-secure", false, "only send cookies over HTTPS")
+	cookie_samesite := flag.String("cookie-samesite", "", "cookie SameSite attribute: 'lax', 'strict' or 'none', not set if empty")
+	session_lifetime := flag.Duration("session-lifetime", 7 * 24 * time.Hour, "absolute session lifetime, session can not be extended past it")
+	session_idle := flag.Duration("session-idle-timeout", 0, "session expires if it has not been used for this long, " +
+		"every request extends it up to session lifetime, 0 disables idle timeout")
+	oidc_name := flag.String("oidc-name", "oidc", "name of the OIDC provider, used to link external identities to local users")
+	oidc_issuer := flag.String("oidc-issuer", "", "OIDC issuer URL, OIDC login is disabled if empty")
+	oidc_client_id := flag.String("oidc-client-id", "", "OIDC client id")
+	oidc_client_secret := flag.String("oidc-client-secret", "", "OIDC client secret")
+	oidc_redirect := flag.String("oidc-redirect", "", "OIDC redirect URL, must point to /oidc/callback handler")
+	oidc_success := flag.String("oidc-success-redirect", "/", "where to redirect user after successful OIDC login")
+	totp_issuer := flag.String("totp-issuer", "apparat", "issuer name shown in authenticator applications")
+	mailer_type := flag.String("mailer", "log", "how to deliver email: 'smtp' or 'log'")
+	mail_log := flag.String("mail-log", "", "file where 'log' mailer appends messages, messages are logged if empty")
+	smtp_addr := flag.String("smtp-addr", "", "SMTP server address, host:port")
+	smtp_from := flag.String("smtp-from", "", "sender address of outgoing email")
+	smtp_user := flag.String("smtp-user", "", "SMTP username, authentication is not used if empty")
+	smtp_password := flag.String("smtp-password", "", "SMTP password")
+	base_url := flag.String("base-url", "", "public URL of the service used in links sent by email, like https://apparat.example.com")
+	login_free := flag.Int("login-free-attempts", 5, "number of failed login attempts before exponential backoff starts")
+	login_lock_after := flag.Int("login-lockout-attempts", 20, "number of failed login attempts which lock username or client out, 0 disables lockout")
+	login_lockout := flag.Duration("login-lockout", 15 * time.Minute, "how long username or client stays locked out")
+	service_key := flag.String("service-key", "", "key shared with aggregator, it is required to record account deletion progress, " +
+		"account deletion is disabled if empty")
+	password_cost := flag.Int("password-cost", bcrypt.DefaultCost, "bcrypt cost used to hash stored passwords")
+	ldap_url := flag.String("ldap-url", "", "LDAP server URL, ldap://host:389 or ldaps://host:636, LDAP login is disabled if empty")
+	ldap_starttls := flag.Bool("ldap-starttls", false, "use StartTLS with ldap:// server")
+	ldap_insecure := flag.Bool("ldap-insecure-skip-verify", false, "do not verify LDAP server certificate")
+	ldap_user_dn := flag.String("ldap-user-dn", "", "user DN template used to bind, like 'uid=%s,ou=people,dc=example,dc=com'")
+	ldap_name_attr := flag.String("ldap-name-attr", "cn", "LDAP attribute which holds user's real name")
+	ldap_email_attr := flag.String("ldap-email-attr", "mail", "LDAP attribute which holds user's email")
+	ldap_group_base := flag.String("ldap-group-base", "", "base DN to search groups of the user")
+	ldap_group_filter := flag.String("ldap-group-filter", "(member=%s)", "filter to search groups of the user, '%s' is replaced with user DN")
+	ldap_group_attr := flag.String("ldap-group-attr", "cn", "LDAP attribute which holds group name")
+	var trusted_proxies sslice
+	flag.Var(&trusted_proxies, "trusted-proxy", "address or network of the aggregator, only these peers may set X-Forwarded-For, " +
+		"client address is taken from the connection if none is set, can be specified multiple times")
+	var ldap_group_roles sslice
+	flag.Var(&ldap_group_roles, "ldap-group-role", "group=role mapping, roles of LDAP users are synced from their groups on every login " +
+		"if at least one mapping is set, can be specified multiple times")
+
+	flag.Parse()
+	if *addr == "" {
+		log.Fatalf("You must provide address where auth server will listen for incoming connections")
+	}
+	if *dbparams == "" && *store_type != "memory" {
+		log.Fatalf("You must provide %s auth database parameters", *store_type)
+	}
+	if *cookie_auth == "" && *cookie_keyring == "" {
+		log.Fatalf("you must provide auth key or keyring")
+	}
+
+	serviceKey = *service_key
+	if serviceKey == "" {
+		glog.Warningf("no service key, account deletion is disabled")
+	}
+
+	err := auth.SetPasswordCost(*password_cost)
+	if err != nil {
+		log.Fatalf("invalid password cost: %v", err)
+	}
+
+	authCtl, err = auth.NewAuthCtl(*store_type, *dbparams)
+	if err != nil {
+		log.Fatalf("could not open %s user store '%s': %v", *store_type, *dbparams, err)
+	}
+	defer authCtl.Close()
+
+	cookie_keys, err := auth.CookieKeys(*cookie_keyring, *cookie_auth, *cookie_encrypt)
+	if err != nil {
+		log.Fatalf("could not load cookie keys: %v", err)
+	}
+
+	auth.InitCookieStore(cookie_keys, *cookie_path)
+
+	same_site, err := auth.ParseSameSite(*cookie_samesite)
+	if err != nil {
+		log.Fatalf("invalid cookie attributes: %v", err)
+	}
+	err = auth.SetCookieAttributes(*cookie_domain, *cookie_secure, same_site)
+	if err != nil {
+		log.Fatalf("invalid cookie attributes: %v", err)
+	}
+	err = auth.SetSessionTimeouts(*session_lifetime, *session_idle)
+	if err != nil {
+		log.Fatalf("invalid session timeouts: %v", err)
+	}
+	if *cookie_keyring != "" {
+		auth.WatchKeyring(*cookie_keyring)
+	}
+
+	if *oidc_issuer != "" {
+		if *oidc_client_id == "" || *oidc_redirect == "" {
+			log.Fatalf("OIDC login requires client id and redirect URL")
+		}
+
+		oidcProvider, err = auth.NewOIDCProvider(*oidc_name, *oidc_issuer, *oidc_client_id, *oidc_client_secret, *oidc_redirect)
+		if err != nil {
+			log.Fatalf("could not initialize OIDC provider: %v", err)
+		}
+		oidcSuccessRedirect = *oidc_success
+	}
+
+	if *ldap_url != "" {
+		group_roles := make(map[string]string)
+		for _, gr := range ldap_group_roles {
+			kv := strings.SplitN(gr, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("invalid LDAP group to role mapping '%s', must be group=role", gr)
+			}
+			group_roles[kv[0]] = kv[1]
+		}
+
+		la, err := auth.NewLDAPAuth(auth.LDAPConfig {
+			URL:			*ldap_url,
+			StartTLS:		*ldap_starttls,
+			InsecureSkipVerify:	*ldap_insecure,
+			UserDN:			*ldap_user_dn,
+			NameAttr:		*ldap_name_attr,
+			EmailAttr:		*ldap_email_attr,
+			GroupBase:		*ldap_group_base,
+			GroupFilter:		*ldap_group_filter,
+			GroupAttr:		*ldap_group_attr,
+			GroupRoles:		group_roles,
+		})
+		if err != nil {
+			log.Fatalf("could not initialize LDAP authentication: %v", err)
+		}
+		authCtl.SetLDAP(la)
+	}
+
+	totpIssuer = *totp_issuer
+	loginLimiter = auth.NewLimiter(*login_free, *login_lock_after, *login_lockout)
+
+	switch *mailer_type {
+	case "smtp":
+		if *smtp_addr == "" || *smtp_from == "" {
+			log.Fatalf("smtp mailer requires smtp server address and sender address")
+		}
+
+		mailer = &auth.SMTPMailer {
+			Addr:		*smtp_addr,
+			From:		*smtp_from,
+			Username:	*smtp_user,
+			Password:	*smtp_password,
+		}
+	case "log":
+		mailer = &auth.LogMailer {
+			Path:		*mail_log,
+		}
+	default:
+		log.Fatalf("unsupported mailer '%s'", *mailer_type)
+	}
+	baseURL = strings.TrimRight(*base_url, "/")
+
+	for _, name := range admin_names {
+		err = authCtl.AddRole(name, auth.RoleAdmin)
+		if err != nil {
+			log.Fatalf("could not grant admin role to user %s: %v", name, err)
+		}
+	}
+
+	r := gin.New()
+	// client address is used as a login limiter key, it must not be taken from headers set by arbitrary clients
+	err = r.SetTrustedProxies(trusted_proxies)
+	if err != nil {
+		log.Fatalf("invalid trusted proxies: %v", err)
+	}
+
+	r.Use(middleware.XTrace())
+	r.Use(middleware.Logger())
+	r.Use(gin.Recovery())
+	r.Use(middleware.ClearGorillaContext())
+	r.Use(middleware.CORS())
+
+	r.GET("/ping", func(c *gin.Context) {
+		err := authCtl.Ping()
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H {
+				"message": err,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H {
+			"message": "Ok",
+		})
+	})
+
+	r.POST("/login", user_login)
+	r.POST("/login/totp", user_login_totp)
+	r.POST("/signup", user_signup)
+	r.POST("/check", check_cookie)
+	r.GET("/email/verify", email_verify)
+	r.POST("/email/verify", email_verify)
+	r.POST("/password/reset/request", password_reset_request)
+	r.POST("/password/reset", password_reset)
+
+	if oidcProvider != nil {
+		r.GET("/oidc/login", oidc_login)
+		r.GET("/oidc/callback", oidc_callback)
+	}
+
+	authorized := r.Group("/", auth_required())
+	authorized.POST("/update", user_update)
+	authorized.GET("/me", user_me)
+	authorized.PATCH("/me", user_me_update)
+	authorized.POST("/logout", user_logout)
+	authorized.POST("/logout_all", user_logout_all)
+	authorized.POST("/email/verify/send", email_verify_send)
+	authorized.POST("/totp/enroll", totp_enroll)
+	authorized.POST("/totp/confirm", totp_confirm)
+	authorized.POST("/totp/disable", totp_disable)
+	authorized.POST("/tokens/create", token_create)
+	authorized.GET("/tokens", token_list)
+	authorized.POST("/tokens/revoke", token_revoke)
+	authorized.POST("/account/delete", account_delete)
+	authorized.GET("/account/delete", account_delete_status)
+
+	// only aggregator, which actually purges data, can move deletion forward
+	deleting := authorized.Group("/account/delete", service_required(), middleware.RequireScope(auth.ScopeDelete))
+	deleting.POST("/progress", account_delete_progress)
+	deleting.POST("/finish", account_delete_finish)
+
+	admin := authorized.Group("/admin", middleware.RequireRole(auth.RoleAdmin))
+	admin.GET("/users", admin_users)
+	admin.POST("/users/disable", admin_users_disable)
+	admin.POST("/users/roles", admin_users_roles)
+	admin.POST("/revoke", admin_revoke)
+	admin.GET("/lockouts", admin_lockouts)
+	admin.POST("/lockouts/clear", admin_lockouts_clear)
+	admin.GET("/audit", admin_audit)
+	admin.GET("/audit/export", admin_audit_export)
 
 	http.ListenAndServe(*addr, r)
 }
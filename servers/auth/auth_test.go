@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/bioothod/apparat/services/auth"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIdP is a stand-in identity provider, it issues ID token for @subject with nonce of the last authorization request
+type testIdP struct {
+	server			*httptest.Server
+	key			*rsa.PrivateKey
+	subject			string
+	nonce			string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate signing key: %v", err)
+	}
+
+	idp := &testIdP {
+		key:		key,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"issuer":				idp.server.URL,
+			"authorization_endpoint":		idp.server.URL + "/authorize",
+			"token_endpoint":			idp.server.URL + "/token",
+			"jwks_uri":				idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported":	[]string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"keys": []map[string]string {
+				{
+					"kty":	"RSA",
+					"alg":	"RS256",
+					"use":	"sig",
+					"kid":	"test",
+					"n":	base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":	base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"access_token":		"access",
+			"token_type":		"Bearer",
+			"expires_in":		3600,
+			"id_token":		idp.sign(t),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) sign(t *testing.T) string {
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("could not pack token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	now := time.Now()
+	data := enc(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + enc(map[string]interface{} {
+		"iss":			idp.server.URL,
+		"aud":			"client",
+		"sub":			idp.subject,
+		"nonce":		idp.nonce,
+		"iat":			now.Unix(),
+		"exp":			now.Add(time.Hour).Unix(),
+		"preferred_username":	idp.subject,
+	})
+
+	sum := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func totpNow(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("could not decode TOTP secret: %v", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix() / 30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum) - 1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff) % 1000000)
+}
+
+func cookieNames(rec *httptest.ResponseRecorder) map[string]bool {
+	names := make(map[string]bool)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			names[c.Name] = true
+		}
+	}
+	return names
+}
+
+func TestOIDCCallbackSecondFactor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	err := auth.SetPasswordCost(bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not set password cost: %v", err)
+	}
+	auth.InitCookieStore([][]byte{[]byte("test-auth-key")}, "/")
+
+	authCtl, err = auth.NewAuthCtl("memory", "")
+	if err != nil {
+		t.Fatalf("could not create auth controller: %v", err)
+	}
+	defer authCtl.Close()
+	loginLimiter = auth.NewLimiter(5, 0, time.Minute)
+
+	idp := newTestIdP(t)
+	idp.subject = "alice"
+	oidcProvider, err = auth.NewOIDCProvider("test", idp.server.URL, "client", "secret", "http://apparat/oidc/callback")
+	if err != nil {
+		t.Fatalf("could not create OIDC provider: %v", err)
+	}
+	oidcSuccessRedirect = "/"
+
+	r := gin.New()
+	r.GET("/oidc/login", oidc_login)
+	r.GET("/oidc/callback", oidc_callback)
+
+	login := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/oidc/login", nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("login: status: %d, body: %s", rec.Code, rec.Body.String())
+		}
+
+		u, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("login: invalid redirect: %v", err)
+		}
+		idp.nonce = u.Query().Get("nonce")
+
+		req := httptest.NewRequest("GET", "/oidc/callback?code=code&state=" + url.QueryEscape(u.Query().Get("state")), nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := login()
+	if rec.Code != http.StatusFound || !cookieNames(rec)[auth.CookieName] {
+		t.Fatalf("login without second factor: status: %d, cookies: %v, body: %s",
+			rec.Code, cookieNames(rec), rec.Body.String())
+	}
+
+	secret, err := authCtl.EnrollTOTP("alice")
+	if err != nil {
+		t.Fatalf("could not enroll TOTP: %v", err)
+	}
+	_, err = authCtl.ConfirmTOTP("alice", totpNow(t, secret))
+	if err != nil {
+		t.Fatalf("could not confirm TOTP: %v", err)
+	}
+
+	rec = login()
+	cookies := cookieNames(rec)
+	if rec.Code != http.StatusOK || cookies[auth.CookieName] || !cookies[auth.PendingLoginCookieName] {
+		t.Fatalf("login with second factor: status: %d, cookies: %v, body: %s", rec.Code, cookies, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"second_factor":"totp"`) {
+		t.Errorf("login with second factor: second factor step has not been requested: %s", rec.Body.String())
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"github.com/bioothod/apparat/middleware"
+	"github.com/bioothod/apparat/services/auth"
 	"github.com/bioothod/apparat/services/common"
 	"github.com/bioothod/apparat/services/index"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"time"
 )
 
 var idxCtl *index.IndexCtl
@@ -38,6 +40,17 @@ func index_tags(c *gin.Context) {
 		return
 	}
 
+	err = ireq.CheckTags()
+	if err != nil {
+		estr := fmt.Sprintf("invalid index request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "index", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "index",
+			"error": estr,
+		})
+		return
+	}
+
 	err = idx.Index(&ireq)
 	if err != nil {
 		estr := fmt.Sprintf("could not index tags from user '%s', error: %v", username, err)
@@ -54,6 +67,172 @@ func index_tags(c *gin.Context) {
 	})
 }
 
+func untag(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "untag", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "untag",
+			"error": estr,
+		})
+		return
+	}
+
+	var ireq index.IndexRequest
+	err = c.BindJSON(&ireq)
+	if err != nil {
+		estr := fmt.Sprintf("could not parse json request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "untag", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "untag",
+			"error": estr,
+		})
+		return
+	}
+
+	err = ireq.CheckUntag()
+	if err != nil {
+		estr := fmt.Sprintf("invalid untag request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "untag", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "untag",
+			"error": estr,
+		})
+		return
+	}
+
+	err = idx.Untag(&ireq)
+	if err != nil {
+		estr := fmt.Sprintf("could not untag files of user '%s', error: %v", username, err)
+		common.NewErrorString(c, "untag", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "untag",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "untag",
+	})
+}
+
+func tag_delete(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "tag_delete", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "tag_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	var req index.DeleteRequest
+	err = c.BindJSON(&req)
+	if err == nil {
+		err = index.CheckUserTag(req.Tag)
+	}
+	if err != nil {
+		estr := fmt.Sprintf("invalid tag delete request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "tag_delete", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "tag_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	found, err := idx.DeleteTag(req.Tag)
+	if err != nil {
+		estr := fmt.Sprintf("could not delete tag '%s' of user '%s', error: %v", req.Tag, username, err)
+		common.NewErrorString(c, "tag_delete", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "tag_delete",
+			"error": estr,
+		})
+		return
+	}
+	if !found {
+		estr := fmt.Sprintf("user '%s' does not have tag '%s'", username, req.Tag)
+		common.NewErrorString(c, "tag_delete", estr)
+		c.JSON(http.StatusNotFound, gin.H {
+			"operation": "tag_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "tag_delete",
+		"tag": req.Tag,
+	})
+}
+
+func tag_rename(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "tag_rename", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "tag_rename",
+			"error": estr,
+		})
+		return
+	}
+
+	var req index.RenameRequest
+	err = c.BindJSON(&req)
+	if err == nil {
+		err = index.CheckUserTag(req.Tag)
+	}
+	if err == nil {
+		err = index.CheckUserTag(req.New)
+	}
+	if err == nil && req.Tag == req.New {
+		err = fmt.Errorf("tag '%s' can not be renamed to itself", req.Tag)
+	}
+	if err != nil {
+		estr := fmt.Sprintf("invalid tag rename request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "tag_rename", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "tag_rename",
+			"error": estr,
+		})
+		return
+	}
+
+	found, err := idx.RenameTag(req.Tag, req.New)
+	if err != nil {
+		estr := fmt.Sprintf("could not rename tag '%s' of user '%s' to '%s', error: %v", req.Tag, username, req.New, err)
+		common.NewErrorString(c, "tag_rename", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "tag_rename",
+			"error": estr,
+		})
+		return
+	}
+	if !found {
+		estr := fmt.Sprintf("user '%s' does not have tag '%s'", username, req.Tag)
+		common.NewErrorString(c, "tag_rename", estr)
+		c.JSON(http.StatusNotFound, gin.H {
+			"operation": "tag_rename",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "tag_rename",
+		"tag": req.New,
+	})
+}
+
 func list_meta_tags(c *gin.Context) {
 	username := c.MustGet("username").(string)
 	idx, err := index.NewIndexer(username, idxCtl)
@@ -109,6 +288,17 @@ func list_tags(c *gin.Context) {
 		return
 	}
 
+	err = obj.Check()
+	if err != nil {
+		estr := fmt.Sprintf("invalid list request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "list", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "list",
+			"error": estr,
+		})
+		return
+	}
+
 	reply, err := idx.List(&obj)
 	if err != nil {
 		estr := fmt.Sprintf("could not list tags from user '%s', error: %v", username, err)
@@ -126,6 +316,149 @@ func list_tags(c *gin.Context) {
 	})
 }
 
+func search(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "search", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "search",
+			"error": estr,
+		})
+		return
+	}
+
+	var req index.SearchRequest
+	err = c.BindJSON(&req)
+	if err == nil {
+		err = req.Check()
+	}
+	if err != nil {
+		estr := fmt.Sprintf("invalid search request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "search", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "search",
+			"error": estr,
+		})
+		return
+	}
+
+	reply, err := idx.Search(&req)
+	if err != nil {
+		estr := fmt.Sprintf("could not search files of user '%s', error: %v", username, err)
+		common.NewErrorString(c, "search", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "search",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "search",
+		"reply": reply,
+	})
+}
+
+func usage_reply(c *gin.Context, username string) {
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "usage", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "usage",
+			"error": estr,
+		})
+		return
+	}
+
+	usage, err := idx.Usage()
+	if err != nil {
+		estr := fmt.Sprintf("could not read usage of user '%s', error: %v", username, err)
+		common.NewErrorString(c, "usage", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "usage",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "usage",
+		"usage": usage,
+	})
+}
+
+func user_usage(c *gin.Context) {
+	usage_reply(c, c.MustGet("username").(string))
+}
+
+func admin_usage(c *gin.Context) {
+	usage_reply(c, c.Param("username"))
+}
+
+// account_files lists every file of the user whose account is being deleted, so that its objects can be removed
+func account_files(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "account_files", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "account_files",
+			"error": estr,
+		})
+		return
+	}
+
+	files, err := idx.Files()
+	if err != nil {
+		estr := fmt.Sprintf("could not list files of user '%s', error: %v", username, err)
+		common.NewErrorString(c, "account_files", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "account_files",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_files",
+		"files": files,
+	})
+}
+
+// account_purge drops all index tables of the user whose account is being deleted
+func account_purge(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	idx, err := index.NewIndexer(username, idxCtl)
+	if err != nil {
+		estr := fmt.Sprintf("could not create new indexer for user '%s', error: %v", username, err)
+		common.NewErrorString(c, "account_purge", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "account_purge",
+			"error": estr,
+		})
+		return
+	}
+
+	err = idx.Drop()
+	if err != nil {
+		estr := fmt.Sprintf("could not drop index of user '%s', error: %v", username, err)
+		common.NewErrorString(c, "account_purge", estr)
+		c.JSON(http.StatusInternalServerError, gin.H {
+			"operation": "account_purge",
+			"error": estr,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_purge",
+	})
+}
+
 func main() {
 	addr := flag.String("addr", "", "address to listen auth server at")
 	dbparams := flag.String("db", "", "mysql database parameters:\n" +
@@ -133,7 +466,15 @@ func main() {
 		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
 		"	user:password@/dbname\n" +
 		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
-	auth := flag.String("auth", "", "authentication check service (full-featured URL like http://auth.example.com:1234/check)")
+	auth_url := flag.String("auth", "", "authentication check service (full-featured URL like http://auth.example.com:1234/check)")
+	verify := flag.String("verify", "remote", "auth verification mode: 'remote' checks every request at auth server, " +
+		"'local' checks cookie signature locally and only asks auth server about revocation")
+	cookie_auth := flag.String("cookie-auth", "", "key to authenticate cookies, must match auth server, required for local verification")
+	cookie_encrypt := flag.String("cookie-encrypt", "", "key to encrypt cookies, must match auth server")
+	cookie_keyring := flag.String("cookie-keyring", "", "file with cookie keys, must match auth server keyring, " +
+		"overrides -cookie-auth and -cookie-encrypt, reloaded on SIGHUP")
+	verify_ttl := flag.Duration("verify-cache-ttl", 30 * time.Second, "how long revocation check results are cached in local verification mode")
+	verify_grace := flag.Duration("verify-grace", 5 * time.Minute, "how long cached positive check is trusted when auth server is not available")
 
 
 	flag.Parse()
@@ -143,7 +484,7 @@ func main() {
 	if *dbparams == "" {
 		log.Fatalf("You must provide mysql auth database parameters")
 	}
-	if *auth == "" {
+	if *auth_url == "" {
 		log.Fatalf("You must provide authentication service URL")
 	}
 
@@ -154,6 +495,19 @@ func main() {
 	}
 	defer idxCtl.Close()
 
+	cookie_keys, err := auth.CookieKeys(*cookie_keyring, *cookie_auth, *cookie_encrypt)
+	if err != nil {
+		log.Fatalf("could not load cookie keys: %v", err)
+	}
+
+	verifier, err := auth.NewVerifier(*verify, *auth_url, cookie_keys, *verify_ttl, *verify_grace)
+	if err != nil {
+		log.Fatalf("could not create auth verifier: %v", err)
+	}
+	if *cookie_keyring != "" && *verify == "local" {
+		auth.WatchKeyring(*cookie_keyring)
+	}
+
 	r := gin.New()
 	r.Use(middleware.XTrace())
 	r.Use(middleware.Logger())
@@ -175,10 +529,23 @@ func main() {
 		})
 	})
 
-	authorized := r.Group("/", middleware.AuthRequired(*auth))
-	authorized.POST("/index", index_tags)
-	authorized.POST("/list", list_tags)
-	authorized.POST("/list_meta", list_meta_tags)
+	authorized := r.Group("/", middleware.AuthRequired(verifier))
+	authorized.POST("/index", middleware.RequireScope(auth.ScopeWrite), index_tags)
+	authorized.POST("/untag", middleware.RequireScope(auth.ScopeWrite), untag)
+	authorized.POST("/tag/delete", middleware.RequireScope(auth.ScopeWrite), tag_delete)
+	authorized.POST("/tag/rename", middleware.RequireScope(auth.ScopeWrite), tag_rename)
+	authorized.POST("/list", middleware.RequireScope(auth.ScopeRead), list_tags)
+	authorized.POST("/list_meta", middleware.RequireScope(auth.ScopeRead), list_meta_tags)
+	authorized.POST("/search", middleware.RequireScope(auth.ScopeRead), search)
+	authorized.GET("/usage", middleware.RequireScope(auth.ScopeRead), user_usage)
+
+	// delete scope is granted right before deletion starts, so it can not be taken from the cache
+	deleting := r.Group("/account", middleware.FreshAuthRequired(verifier), middleware.RequireScope(auth.ScopeDelete))
+	deleting.POST("/files", account_files)
+	deleting.POST("/purge", account_purge)
+
+	admin := authorized.Group("/admin", middleware.RequireRole(auth.RoleAdmin))
+	admin.GET("/usage/:username", admin_usage)
 
 	http.ListenAndServe(*addr, r)
 }
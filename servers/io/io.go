@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/bioothod/apparat/middleware"
+	"github.com/bioothod/apparat/services/auth"
 	"github.com/bioothod/apparat/services/common"
 	"github.com/bioothod/apparat/services/io"
 	"github.com/gin-gonic/gin"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var ioCtl *io.IOCtl
@@ -85,6 +87,43 @@ func upload_handler(c *gin.Context) {
 	})
 }
 
+type PurgeRequest struct {
+	Files		[]common.Reply		`json:"files"`
+}
+
+// purge_handler removes objects of the user whose account is being deleted
+func purge_handler(c *gin.Context) {
+	username := c.MustGet("username").(string)
+
+	var req PurgeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		estr := fmt.Sprintf("could not parse json request from user '%s', error: %v", username, err)
+		common.NewErrorString(c, "purge", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "purge",
+			"error": estr,
+		})
+		return
+	}
+
+	removed, err := ioCtl.Purge(req.Files, common.UsernameModifier(username))
+	if err != nil {
+		common.NewError(c, "purge", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "purge",
+			"error": err.Error(),
+			"removed": removed,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "purge",
+		"removed": removed,
+	})
+}
+
 type sslice []string
 func (sl *sslice) String() string {
 	return fmt.Sprintf("%s", *sl)
@@ -100,7 +139,15 @@ func main() {
 
 	addr := flag.String("addr", "", "address to listen auth server at")
 	mgroups := flag.String("metadata-groups", "", "colon-separated list of metadata groups, format: 1:2:3")
-	auth := flag.String("auth", "", "authentication check service (full-featured URL like http://auth.example.com:1234/check)")
+	auth_url := flag.String("auth", "", "authentication check service (full-featured URL like http://auth.example.com:1234/check)")
+	verify := flag.String("verify", "remote", "auth verification mode: 'remote' checks every request at auth server, " +
+		"'local' checks cookie signature locally and only asks auth server about revocation")
+	cookie_auth := flag.String("cookie-auth", "", "key to authenticate cookies, must match auth server, required for local verification")
+	cookie_encrypt := flag.String("cookie-encrypt", "", "key to encrypt cookies, must match auth server")
+	cookie_keyring := flag.String("cookie-keyring", "", "file with cookie keys, must match auth server keyring, " +
+		"overrides -cookie-auth and -cookie-encrypt, reloaded on SIGHUP")
+	verify_ttl := flag.Duration("verify-cache-ttl", 30 * time.Second, "how long revocation check results are cached in local verification mode")
+	verify_grace := flag.Duration("verify-grace", 5 * time.Minute, "how long cached positive check is trusted when auth server is not available")
 	transcode := flag.String("transcode", "", "Nullx transcoding service host (example: nullx.example.com:1234)")
 	logfile := flag.String("log-file", "/dev/stdout", "Elliptics log file")
 	loglevel := flag.String("log-level", "error", "Elliptics log level (debug, notice, info, error)")
@@ -111,7 +158,7 @@ func main() {
 	if *addr == "" {
 		log.Fatalf("You must provide address where auth server will listen for incoming connections")
 	}
-	if *auth == "" {
+	if *auth_url == "" {
 		log.Fatalf("You must provide authentication service URL")
 	}
 	if len(bnames) == 0 {
@@ -147,6 +194,19 @@ func main() {
 	}
 	defer ioCtl.Close()
 
+	cookie_keys, err := auth.CookieKeys(*cookie_keyring, *cookie_auth, *cookie_encrypt)
+	if err != nil {
+		log.Fatalf("could not load cookie keys: %v", err)
+	}
+
+	verifier, err := auth.NewVerifier(*verify, *auth_url, cookie_keys, *verify_ttl, *verify_grace)
+	if err != nil {
+		log.Fatalf("could not create auth verifier: %v", err)
+	}
+	if *cookie_keyring != "" && *verify == "local" {
+		auth.WatchKeyring(*cookie_keyring)
+	}
+
 	r := gin.New()
 	r.Use(middleware.XTrace())
 	r.Use(middleware.Logger())
@@ -168,11 +228,13 @@ func main() {
 		})
 	})
 
-	authorized := r.Group("/", middleware.AuthRequired(*auth))
-	authorized.POST("/upload/:key", upload_handler)
-	authorized.GET("/get/:bucket/:key", get_handler)
-	authorized.GET("/get_key/:bucket/:key", get_key_handler)
-	authorized.GET("/meta_json/:bucket/:key", meta_json_handler)
+	authorized := r.Group("/", middleware.AuthRequired(verifier))
+	authorized.POST("/upload/:key", middleware.RequireScope(auth.ScopeWrite), upload_handler)
+	authorized.GET("/get/:bucket/:key", middleware.RequireScope(auth.ScopeRead), get_handler)
+	authorized.GET("/get_key/:bucket/:key", middleware.RequireScope(auth.ScopeRead), get_key_handler)
+	authorized.GET("/meta_json/:bucket/:key", middleware.RequireScope(auth.ScopeRead), meta_json_handler)
+	// delete scope is granted right before deletion starts, so it can not be taken from the cache
+	r.POST("/account/purge", middleware.FreshAuthRequired(verifier), middleware.RequireScope(auth.ScopeDelete), purge_handler)
 
 	http.ListenAndServe(*addr, r)
 }
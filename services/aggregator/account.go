@@ -0,0 +1,259 @@
+package aggregator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bioothod/apparat/services/auth"
+	"github.com/bioothod/apparat/services/common"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// number of files removed from storage between two progress updates
+const purgeBatchSize int = 100
+
+// AccountDeleter drives account deletion: it removes user's objects through IO server,
+// drops user's index and finally removes the account at auth server.
+// Auth server keeps deletion stage, so if any step fails the whole request can be repeated and deletion resumes.
+type AccountDeleter struct {
+	AuthAddr		string
+	IndexAddr		string
+	IOAddr			string
+	// auth server only accepts deletion progress with this key
+	ServiceKey		string
+}
+
+type deletionReply struct {
+	Deletion		*auth.Deletion		`json:"deletion"`
+}
+
+// StatusError is returned by call() when backend has replied with non-200 status
+type StatusError struct {
+	Method			string
+	Url			string
+	Status			int
+	Reply			string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("method: %s, url: %s, status: %d, reply: '%s'", e.Method, e.Url, e.Status, e.Reply)
+}
+
+// call sends request to the backend on behalf of the client and unpacks JSON reply into @reply if it is not nil,
+// @extra headers are added to the request
+func call(c *gin.Context, addr, method, path, ctype string, body []byte, extra http.Header, reply interface{}) (http.Header, error) {
+	url := fmt.Sprintf("http://%s%s", addr, path)
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create new request: method: %s, url: %s, error: %v", method, url, err)
+	}
+
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	for _, h := range []string{"Cookie", "Authorization", "X-Request"} {
+		if v := c.Request.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	for h, v := range extra {
+		req.Header[h] = v
+	}
+	// client supplied address headers are dropped, otherwise client could choose its own limiter key
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Del("X-Real-Ip")
+	if host, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform operation: method: %s, url: %s, error: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read reply: method: %s, url: %s, error: %v", method, url, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError {
+			Method:		method,
+			Url:		url,
+			Status:		resp.StatusCode,
+			Reply:		string(data),
+		}
+	}
+
+	if reply != nil {
+		err = json.Unmarshal(data, reply)
+		if err != nil {
+			return nil, fmt.Errorf("could not unpack JSON reply: method: %s, url: %s, reply: '%s', error: %v",
+				method, url, string(data), err)
+		}
+	}
+
+	return resp.Header, nil
+}
+
+func (ad *AccountDeleter) callJSON(c *gin.Context, addr, path string, body interface{}, reply interface{}) (http.Header, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not pack JSON request: '%v', error: %v", body, err)
+	}
+
+	var extra http.Header
+	if addr == ad.AuthAddr {
+		extra = http.Header{}
+		extra.Set(auth.ServiceKeyHeader, ad.ServiceKey)
+	}
+
+	return call(c, addr, "POST", path, "application/json", data, extra, reply)
+}
+
+func (ad *AccountDeleter) progress(c *gin.Context, stage string, objects int, errstr string) (*auth.Deletion, error) {
+	type progressRequest struct {
+		Stage			string		`json:"stage"`
+		Objects			int		`json:"objects"`
+		Error			string		`json:"error"`
+	}
+
+	var reply deletionReply
+	_, err := ad.callJSON(c, ad.AuthAddr, "/account/delete/progress", &progressRequest {
+		Stage:		stage,
+		Objects:	objects,
+		Error:		errstr,
+	}, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Deletion, nil
+}
+
+func (ad *AccountDeleter) purgeObjects(c *gin.Context) error {
+	type filesReply struct {
+		Files			[]common.Reply		`json:"files"`
+	}
+	var files filesReply
+
+	_, err := ad.callJSON(c, ad.IndexAddr, "/account/files", gin.H{}, &files)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(files.Files); start += purgeBatchSize {
+		end := start + purgeBatchSize
+		if end > len(files.Files) {
+			end = len(files.Files)
+		}
+
+		_, err = ad.callJSON(c, ad.IOAddr, "/account/purge", gin.H {
+			"files": files.Files[start:end],
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = ad.progress(c, auth.DeletionObjects, end - start, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ad *AccountDeleter) run(c *gin.Context, d *auth.Deletion) (*auth.Deletion, error) {
+	if d.Stage == auth.DeletionObjects {
+		err := ad.purgeObjects(c)
+		if err != nil {
+			return d, err
+		}
+
+		next, err := ad.progress(c, auth.DeletionIndex, 0, "")
+		if err != nil {
+			return d, err
+		}
+		d = next
+	}
+
+	if d.Stage == auth.DeletionIndex {
+		_, err := ad.callJSON(c, ad.IndexAddr, "/account/purge", gin.H{}, nil)
+		if err != nil {
+			return d, err
+		}
+
+		next, err := ad.progress(c, auth.DeletionAccount, 0, "")
+		if err != nil {
+			return d, err
+		}
+		d = next
+	}
+
+	hdr, err := ad.callJSON(c, ad.AuthAddr, "/account/delete/finish", gin.H{}, nil)
+	if err != nil {
+		return d, err
+	}
+
+	// auth server clears cookie of the removed account
+	for _, v := range hdr["Set-Cookie"] {
+		c.Writer.Header().Add("Set-Cookie", v)
+	}
+
+	return d, nil
+}
+
+// Delete starts or resumes account deletion, request body (password and optional second factor code) is passed to auth server
+func (ad *AccountDeleter) Delete(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		estr := fmt.Sprintf("could not read request: %v", err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusBadRequest, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	var start deletionReply
+	_, err = call(c, ad.AuthAddr, "POST", "/account/delete", c.Request.Header.Get("Content-Type"), body, nil, &start)
+	if err != nil || start.Deletion == nil {
+		estr := fmt.Sprintf("could not start account deletion: %v", err)
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+		})
+		return
+	}
+
+	d, err := ad.run(c, start.Deletion)
+	if err != nil {
+		estr := fmt.Sprintf("account deletion has failed at stage '%s', repeat request to resume: %v", d.Stage, err)
+
+		// best effort, progress update can fail for the same reason
+		if updated, perr := ad.progress(c, d.Stage, 0, err.Error()); perr == nil {
+			d = updated
+		}
+
+		common.NewErrorString(c, "account_delete", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "account_delete",
+			"error": estr,
+			"deletion": d,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H {
+		"operation": "account_delete",
+		"deleted": d.Username,
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/bioothod/apparat/services/common"
 	"github.com/gin-gonic/gin"
 	"io"
+	"net"
 	"net/http"
 )
 
@@ -26,7 +27,20 @@ func (f *Forwarder) Send(c *gin.Context) (*http.Response, error) {
 
 	req.Header = c.Request.Header
 
-	client := &http.Client{}
+	// backends need real client address, for example to limit login attempts
+	// client supplied address headers are dropped, otherwise client could choose its own limiter key
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Del("X-Real-Ip")
+	if host, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	client := &http.Client {
+		// redirects (like OIDC login) have to be passed to the client as is
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not perform operation: method: %s, url: %s, error: %v", method, url.String(), err)
@@ -18,6 +18,22 @@ type Indexer struct {
 	Forwarder
 
 	IndexUrl		string
+	// auth server is asked whether user's account is being deleted, uploads are refused in that case
+	AuthAddr		string
+}
+
+// deleting returns non-nil deletion if auth server has started deletion of the user's account
+func (idx *Indexer) deleting(c *gin.Context) (*auth.Deletion, error) {
+	var reply deletionReply
+	_, err := call(c, idx.AuthAddr, "GET", "/account/delete", "", nil, nil, &reply)
+	if err != nil {
+		if se, ok := err.(*StatusError); ok && se.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return reply.Deletion, nil
 }
 
 func (idx *Indexer) FormatError(c *gin.Context, format string, args ...interface{}) string {
@@ -43,6 +59,27 @@ func (idx *Indexer) Forward(c *gin.Context) {
 		return
 	}
 
+	// files uploaded after the purge would outlive the account
+	d, err := idx.deleting(c)
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if se, ok := err.(*StatusError); ok {
+			status = se.Status
+		}
+		c.JSON(status, gin.H {
+			"operation": "forward",
+			"error": idx.FormatError(c, "could not check account deletion state: %v", err),
+		})
+		return
+	}
+	if d != nil {
+		c.JSON(http.StatusForbidden, gin.H {
+			"operation": "forward",
+			"error": idx.FormatError(c, "account %s is being deleted, stage: %s", d.Username, d.Stage),
+		})
+		return
+	}
+
 	resp, err := idx.Send(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H {
@@ -118,6 +155,8 @@ func (idx *Indexer) Forward(c *gin.Context) {
 					Name:		r.Name,
 					Timestamp:	r.Timestamp,
 					Size:		r.Size,
+					ContentType:	r.ContentType,
+					Media:		r.Media,
 				},
 				Tags: tags,
 			},
@@ -148,6 +187,9 @@ func (idx *Indexer) Forward(c *gin.Context) {
 	if err == nil {
 		index_req.AddCookie(cookie)
 	}
+	if hdr := c.Request.Header.Get("Authorization"); hdr != "" {
+		index_req.Header.Set("Authorization", hdr)
+	}
 
 	index_resp, err := client.Do(index_req)
 	if err != nil {
@@ -0,0 +1,84 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bioothod/apparat/services/common"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+)
+
+// Profile replies to 'who am I' requests: user data and session state come from auth server,
+// storage usage comes from index server
+type Profile struct {
+	AuthAddr		string
+	IndexAddr		string
+}
+
+func (p *Profile) Get(c *gin.Context) {
+	auth := &Forwarder {
+		Addr:	p.AuthAddr,
+	}
+
+	resp, err := auth.Send(c)
+	if err != nil {
+		estr := fmt.Sprintf("could not read profile: %v", err)
+		common.NewErrorString(c, "me", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "me",
+			"error": estr,
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	// not authenticated or auth server failure, client gets it as is
+	if resp.StatusCode != http.StatusOK {
+		auth.Flush(c, resp)
+		return
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		estr := fmt.Sprintf("could not read profile reply: %v", err)
+		common.NewErrorString(c, "me", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "me",
+			"error": estr,
+		})
+		return
+	}
+
+	var reply map[string]json.RawMessage
+	err = json.Unmarshal(data, &reply)
+	if err != nil {
+		estr := fmt.Sprintf("could not unpack profile reply: '%s', error: %v", string(data), err)
+		common.NewErrorString(c, "me", estr)
+		c.JSON(http.StatusServiceUnavailable, gin.H {
+			"operation": "me",
+			"error": estr,
+		})
+		return
+	}
+
+	// auth server could have re-signed the cookie
+	for _, v := range resp.Header["Set-Cookie"] {
+		c.Writer.Header().Add("Set-Cookie", v)
+	}
+
+	// profile is still useful without usage, so index server failure is only reported in the reply
+	var usage struct {
+		Usage			json.RawMessage		`json:"usage"`
+	}
+	_, err = call(c, p.IndexAddr, "GET", "/usage", "", nil, nil, &usage)
+	if err != nil {
+		estr := fmt.Sprintf("could not read storage usage: %v", err)
+		common.NewErrorString(c, "me", estr)
+		reply["usage_error"], _ = json.Marshal(estr)
+	} else {
+		reply["usage"] = usage.Usage
+	}
+
+	c.JSON(http.StatusOK, reply)
+}
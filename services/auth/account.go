@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+)
+
+// account deletion goes through these stages in order, every stage can be repeated if it fails
+const (
+	// user's objects are being removed from storage
+	DeletionObjects string = "objects"
+	// user's index tables are being dropped
+	DeletionIndex string = "index"
+	// only the account itself is left
+	DeletionAccount string = "account"
+)
+
+var deletionStages = []string{DeletionObjects, DeletionIndex, DeletionAccount}
+
+// session which started account deletion gets this scope, services only allow purging data with it
+const ScopeDelete string = "delete"
+
+// ScopeDelete is only granted for this long after deletion has been started or has made progress,
+// stalled deletion has to be started again with password
+const DeletionScopeTimeout time.Duration = 15 * time.Minute
+
+// deletion progress is only accepted from the service which purges data (aggregator), not from the user,
+// the service sends the key shared with auth server in this header
+const ServiceKeyHeader string = "X-Service-Key"
+
+// CheckServiceKey compares key from the request with the configured one, empty configured key rejects everything
+func CheckServiceKey(key, want string) bool {
+	if want == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+}
+
+type Deletion struct {
+	Username		string		`json:"username"`
+	Stage			string		`json:"stage"`
+	Objects			uint64		`json:"objects"`
+	Error			string		`json:"error,omitempty"`
+	Created			time.Time	`json:"created"`
+	Updated			time.Time	`json:"updated"`
+
+	// only this session gets ScopeDelete and only until @ScopeExpiredAt
+	Session			string		`json:"-"`
+	ScopeExpiredAt		time.Time	`json:"scope_expired_at"`
+}
+
+// HasScope returns true if session @id is allowed to purge data of the account
+func (d *Deletion) HasScope(id string, now time.Time) bool {
+	return d.Session != "" && d.Session == id && now.Before(d.ScopeExpiredAt)
+}
+
+func deletionStage(stage string) int {
+	for i, s := range deletionStages {
+		if s == stage {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// StartDeletion creates account deletion job, if there is one already it is returned as is, so that it can be resumed,
+// in both cases session @session gets ScopeDelete for DeletionScopeTimeout
+func (ctl *AuthCtl) StartDeletion(username, session string) (*Deletion, error) {
+	d, err := ctl.store.ReadDeletion(username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if d != nil {
+		d.Session = session
+		d.ScopeExpiredAt = now.Add(DeletionScopeTimeout)
+
+		err = ctl.store.UpdateDeletion(d)
+		if err != nil {
+			return nil, err
+		}
+
+		return d, nil
+	}
+
+	d = &Deletion {
+		Username:	username,
+		Stage:		DeletionObjects,
+		Created:	now,
+		Updated:	now,
+		Session:	session,
+		ScopeExpiredAt:	now.Add(DeletionScopeTimeout),
+	}
+
+	err = ctl.store.CreateDeletion(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// GetDeletion returns account deletion job of the user or nil if account is not being deleted
+func (ctl *AuthCtl) GetDeletion(username string) (*Deletion, error) {
+	return ctl.store.ReadDeletion(username)
+}
+
+// UpdateDeletion records progress of the deletion job, stage can only be repeated or move to the next one,
+// so that no stage is skipped
+func (ctl *AuthCtl) UpdateDeletion(username, stage string, objects uint64, errstr string) (*Deletion, error) {
+	d, err := ctl.store.ReadDeletion(username)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("account %s is not being deleted", username)
+	}
+
+	next := deletionStage(stage)
+	if next < 0 {
+		return nil, fmt.Errorf("invalid deletion stage '%s', allowed stages: %v", stage, deletionStages)
+	}
+	cur := deletionStage(d.Stage)
+	if next != cur && next != cur + 1 {
+		return nil, fmt.Errorf("account %s deletion is at stage '%s', it can only be repeated or move to the next stage, not to '%s'",
+			username, d.Stage, stage)
+	}
+
+	if stage != d.Stage {
+		d.Objects = 0
+	}
+	d.Stage = stage
+	d.Objects += objects
+	d.Error = errstr
+	d.Updated = time.Now()
+	// deletion which makes progress keeps its scope, failed one has to be started again
+	if errstr == "" {
+		d.ScopeExpiredAt = d.Updated.Add(DeletionScopeTimeout)
+	}
+
+	err = ctl.store.UpdateDeletion(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// FinishDeletion removes account, it is only allowed after all user's data has been purged
+func (ctl *AuthCtl) FinishDeletion(username string) error {
+	d, err := ctl.store.ReadDeletion(username)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return fmt.Errorf("account %s is not being deleted", username)
+	}
+	if d.Stage != DeletionAccount {
+		return fmt.Errorf("account %s can not be removed at deletion stage '%s'", username, d.Stage)
+	}
+
+	return ctl.store.DeleteUser(username)
+}
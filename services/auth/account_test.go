@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateDeletionStages(t *testing.T) {
+	tests := []struct {
+		cur			string
+		next			string
+		ok			bool
+	}{
+		{DeletionObjects, DeletionObjects, true},
+		{DeletionObjects, DeletionIndex, true},
+		{DeletionObjects, DeletionAccount, false},
+		{DeletionIndex, DeletionObjects, false},
+		{DeletionIndex, DeletionIndex, true},
+		{DeletionIndex, DeletionAccount, true},
+		{DeletionAccount, DeletionObjects, false},
+		{DeletionAccount, DeletionIndex, false},
+		{DeletionAccount, DeletionAccount, true},
+		{DeletionObjects, "tables", false},
+		{DeletionObjects, "", false},
+	}
+
+	for _, test := range tests {
+		ctl := newTestCtl(t)
+		newTestUser(t, ctl, "alice", "password")
+
+		d, err := ctl.StartDeletion("alice", "session")
+		if err != nil {
+			t.Fatalf("could not start deletion: %v", err)
+		}
+		d.Stage = test.cur
+		d.Objects = 10
+		err = ctl.store.UpdateDeletion(d)
+		if err != nil {
+			t.Fatalf("could not move deletion to stage %s: %v", test.cur, err)
+		}
+
+		d, err = ctl.UpdateDeletion("alice", test.next, 5, "")
+		if (err == nil) != test.ok {
+			t.Errorf("%s -> %s: error: %v, must succeed: %v", test.cur, test.next, err, test.ok)
+		}
+
+		stored, err := ctl.GetDeletion("alice")
+		if err != nil {
+			t.Fatalf("could not read deletion: %v", err)
+		}
+
+		want_stage, want_objects := test.cur, uint64(10)
+		if test.ok {
+			want_stage = test.next
+			want_objects = 5
+			if test.cur == test.next {
+				want_objects = 15
+			}
+		}
+		if stored.Stage != want_stage || stored.Objects != want_objects {
+			t.Errorf("%s -> %s: stage: %s, objects: %d, want stage: %s, objects: %d",
+				test.cur, test.next, stored.Stage, stored.Objects, want_stage, want_objects)
+		}
+
+		err = ctl.FinishDeletion("alice")
+		if (err == nil) != (want_stage == DeletionAccount) {
+			t.Errorf("%s -> %s: finish at stage %s: error: %v", test.cur, test.next, want_stage, err)
+		}
+	}
+
+	ctl := newTestCtl(t)
+	newTestUser(t, ctl, "alice", "password")
+	_, err := ctl.UpdateDeletion("alice", DeletionObjects, 1, "")
+	if err == nil {
+		t.Errorf("progress of deletion which has not been started has been accepted")
+	}
+}
+
+func TestDeletionScope(t *testing.T) {
+	ctl := newTestCtl(t)
+	newTestUser(t, ctl, "alice", "password")
+
+	owner, err := ctl.NewSession("alice")
+	if err != nil {
+		t.Fatalf("could not create session: %v", err)
+	}
+	other, err := ctl.NewSession("alice")
+	if err != nil {
+		t.Fatalf("could not create session: %v", err)
+	}
+
+	_, err = ctl.StartDeletion("alice", owner.Token)
+	if err != nil {
+		t.Fatalf("could not start deletion: %v", err)
+	}
+
+	check := func(name string, ac *AuthCookie, want bool) {
+		err := ctl.CheckSession(ac)
+		if err != nil {
+			t.Fatalf("%s: could not check session: %v", name, err)
+		}
+		if HasScope(ac.Scopes, ScopeDelete) != want {
+			t.Errorf("%s: scopes: %v, must have %s scope: %v", name, ac.Scopes, ScopeDelete, want)
+		}
+	}
+
+	check("owner", owner, true)
+	check("other session", other, false)
+
+	// failed progress does not extend the scope
+	d, err := ctl.UpdateDeletion("alice", DeletionObjects, 0, "storage is not available")
+	if err != nil {
+		t.Fatalf("could not update deletion: %v", err)
+	}
+	expired := d.ScopeExpiredAt
+
+	d.ScopeExpiredAt = time.Now().Add(-time.Second)
+	err = ctl.store.UpdateDeletion(d)
+	if err != nil {
+		t.Fatalf("could not update deletion: %v", err)
+	}
+	check("expired scope", owner, false)
+
+	d, err = ctl.UpdateDeletion("alice", DeletionObjects, 0, "storage is not available")
+	if err != nil {
+		t.Fatalf("could not update deletion: %v", err)
+	}
+	if d.ScopeExpiredAt.After(expired) {
+		t.Errorf("failed deletion has extended scope until %s", d.ScopeExpiredAt)
+	}
+	check("failed deletion", owner, false)
+
+	// deletion has to be started again, only the new session gets the scope
+	_, err = ctl.StartDeletion("alice", other.Token)
+	if err != nil {
+		t.Fatalf("could not restart deletion: %v", err)
+	}
+	check("restarted by other session", other, true)
+	check("previous owner", owner, false)
+}
+
+func TestCheckServiceKey(t *testing.T) {
+	tests := []struct {
+		key			string
+		want			string
+		ok			bool
+	}{
+		{"secret", "secret", true},
+		{"wrong", "secret", false},
+		{"", "secret", false},
+		{"", "", false},
+		{"secret", "", false},
+	}
+
+	for _, test := range tests {
+		if ok := CheckServiceKey(test.key, test.want); ok != test.ok {
+			t.Errorf("key: '%s', configured: '%s': accepted: %v, want: %v", test.key, test.want, ok, test.ok)
+		}
+	}
+}
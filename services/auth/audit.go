@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"time"
+)
+
+const (
+	AuditLogin string = "login"
+	AuditSignup string = "signup"
+	AuditLogout string = "logout"
+	AuditUpdate string = "update"
+	AuditPasswordReset string = "password_reset"
+	AuditTOTP string = "totp"
+	AuditTokenCreate string = "token_create"
+	AuditTokenRevoke string = "token_revoke"
+	AuditRoles string = "roles"
+	AuditDisable string = "disable"
+	AuditAccountDelete string = "account_delete"
+)
+
+// maximum number of audit events returned by a single query
+const MaxAuditEvents int = 10000
+
+// AuditEvent is a single entry of the append-only audit log, @Username is the user event is about,
+// @Actor is the one who performed the action if it is a different user (like admin)
+type AuditEvent struct {
+	Time			time.Time	`json:"time"`
+	Event			string		`json:"event"`
+	Username		string		`json:"username"`
+	Actor			string		`json:"actor,omitempty"`
+	Success			bool		`json:"success"`
+	RequestID		string		`json:"request_id"`
+	ClientIP		string		`json:"client_ip"`
+	Details			string		`json:"details,omitempty"`
+}
+
+type AuditQuery struct {
+	// all users if empty
+	Username		string
+	Since			time.Time
+	Until			time.Time
+	Limit			int
+}
+
+// Audit appends event to the audit log, failure to write it is logged but does not fail the operation
+func (ctl *AuthCtl) Audit(e *AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	err := ctl.store.AppendAudit(e)
+	if err != nil {
+		glog.Errorf("could not write audit event: %+v: %v", *e, err)
+	}
+}
+
+// ListAudit returns audit events matching the query ordered by time
+func (ctl *AuthCtl) ListAudit(q *AuditQuery) ([]AuditEvent, error) {
+	if q.Limit <= 0 || q.Limit > MaxAuditEvents {
+		q.Limit = MaxAuditEvents
+	}
+	if q.Until.IsZero() {
+		q.Until = time.Now()
+	}
+	if q.Until.Before(q.Since) {
+		return nil, fmt.Errorf("invalid audit query: until %s is before since %s", q.Until, q.Since)
+	}
+
+	return ctl.store.ListAudit(q)
+}
@@ -1,31 +1,31 @@
 package auth
 
 import (
-	_ "github.com/go-sql-driver/mysql"
-	"database/sql"
 	"fmt"
+	"github.com/golang/glog"
 	"time"
 )
 
 type AuthCtl struct {
-	db		*sql.DB
+	store		UserStore
+	ldap		*LDAPAuth
 }
 
 func NewAuthCtl(dbtype, dbparams string) (*AuthCtl, error) {
-	db, err := sql.Open(dbtype, dbparams)
+	store, err := NewUserStore(dbtype, dbparams)
 	if err != nil {
-		return nil, fmt.Errorf("could not open db: %s, params: %s: %v", dbtype, dbparams, err)
+		return nil, err
 	}
 
 	ctl := &AuthCtl {
-		db:		db,
+		store:		store,
 	}
 
 	return ctl, nil
 }
 
 func (ctl *AuthCtl) Close() {
-	ctl.db.Close()
+	ctl.store.Close()
 }
 
 type Mailbox struct {
@@ -34,65 +34,111 @@ type Mailbox struct {
 	Realname		string		`json:"realname"`
 	Email			string		`json:"email"`
 	Created			time.Time	`json:"-"`
+	Roles			[]string	`json:"roles"`
+	Disabled		bool		`json:"disabled"`
 }
 
 func (mbox *Mailbox) String() string {
-	return fmt.Sprintf("username: %s, realname: %s, email: %s, created: '%s'",
-		mbox.Username, mbox.Realname, mbox.Email, mbox.Created.String())
+	return fmt.Sprintf("username: %s, realname: %s, email: %s, created: '%s', roles: %v, disabled: %v",
+		mbox.Username, mbox.Realname, mbox.Email, mbox.Created.String(), mbox.Roles, mbox.Disabled)
 }
 
 func (ctl *AuthCtl) NewUser(mbox *Mailbox) error {
 	mbox.Created = time.Now()
+	if len(mbox.Roles) == 0 {
+		mbox.Roles = []string{RoleUser}
+	}
 
-	_, err := ctl.db.Exec("INSERT INTO users SET username=?,password=?,realname=?,email=?,created=?",
-		mbox.Username, mbox.Password, mbox.Realname, mbox.Email, mbox.Created)
+	err := CheckRoles(mbox.Roles)
 	if err != nil {
 		return fmt.Errorf("could not insert new user: %s: %v", mbox.String(), err)
 	}
 
-	return nil
+	hash, err := HashPassword(mbox.Password)
+	if err != nil {
+		return fmt.Errorf("could not insert new user: %s: %v", mbox.String(), err)
+	}
+
+	return ctl.store.CreateUser(mbox, hash)
+}
+
+// readUser fills @mbox with data stored for @mbox.Username except password, stored password is returned instead
+func (ctl *AuthCtl) readUser(mbox *Mailbox) (string, error) {
+	stored, hash, err := ctl.store.ReadUser(mbox.Username)
+	if err != nil {
+		return "", err
+	}
+
+	mbox.Realname = stored.Realname
+	mbox.Email = stored.Email
+	mbox.Created = stored.Created
+	mbox.Roles = stored.Roles
+	mbox.Disabled = stored.Disabled
+	return hash, nil
+}
+
+// LookupUser fills @mbox with data stored for @mbox.Username without checking password
+func (ctl *AuthCtl) LookupUser(mbox *Mailbox) error {
+	_, err := ctl.readUser(mbox)
+	return err
 }
 
 func (ctl *AuthCtl) GetUser(mbox *Mailbox) error {
-	rows, err := ctl.db.Query("SELECT * FROM users WHERE username=?", mbox.Username)
+	password, err := ctl.readUser(mbox)
+	if err != nil {
+		fakePasswordCheck(mbox.Password)
+		return err
+	}
+
+	rehash, err := CheckPassword(password, mbox.Password)
 	if err != nil {
-		return fmt.Errorf("could not read userinfo for user: %s: %v", mbox.Username, err)
+		return err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var username, password string
+	if mbox.Disabled {
+		return fmt.Errorf("account %s is disabled", mbox.Username)
+	}
 
-		err = rows.Scan(&username, &password, &mbox.Realname, &mbox.Email, &mbox.Created)
+	if rehash {
+		// plaintext or outdated hash, upgrade it transparently now that we know the password
+		err = ctl.updatePassword(mbox.Username, mbox.Password)
 		if err != nil {
-			return fmt.Errorf("database schema mismatch: %v", err)
-		}
-
-		if password != mbox.Password || username != mbox.Username {
-			return fmt.Errorf("username or password mismatch");
-		} else {
-			return nil
+			glog.Errorf("could not upgrade password hash for user %s: %v", mbox.Username, err)
 		}
 	}
 
-	err = rows.Err()
+	return nil
+}
+
+func (ctl *AuthCtl) updatePassword(username, password string) error {
+	hash, err := HashPassword(password)
 	if err != nil {
-		return fmt.Errorf("could not scan database: %v", err)
+		return err
 	}
 
-	return fmt.Errorf("there is no user %s", mbox.Username)
+	return ctl.store.SetPasswordHash(username, hash)
 }
 
+// UpdateUser writes realname, email and password of the user, password is not changed if it is empty
 func (ctl *AuthCtl) UpdateUser(mbox *Mailbox) error {
-	_, err := ctl.db.Exec("UPDATE users SET password=?,realname=?,email=? WHERE username=?",
-		mbox.Password, mbox.Realname, mbox.Email, mbox.Username)
-	if err != nil {
-		return fmt.Errorf("could not update user: %s: %v", mbox.String(), err)
+	var hash string
+	var err error
+
+	if mbox.Password != "" {
+		err = ctl.CanChangePassword(mbox.Username)
+		if err != nil {
+			return err
+		}
+
+		hash, err = HashPassword(mbox.Password)
+		if err != nil {
+			return fmt.Errorf("could not update user: %s: %v", mbox.String(), err)
+		}
 	}
 
-	return nil
+	return ctl.store.UpdateUser(mbox, hash)
 }
 
 func (ctl *AuthCtl) Ping() error {
-	return ctl.db.Ping()
+	return ctl.store.Ping()
 }
@@ -8,7 +8,18 @@ import (
 	"net/http"
 )
 
-func CheckCookieWeb(auth_url string, cookie *http.Cookie) (*AuthCookie, error) {
+// RejectError is returned when auth server has explicitly refused credentials,
+// as opposed to errors when auth server could not be reached
+type RejectError struct {
+	Status			int
+	Reason			string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("auth check has been rejected, status: %d, error: %s", e.Status, e.Reason)
+}
+
+func checkWeb(auth_url string, prepare func(req *http.Request)) (*AuthCookie, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("POST", auth_url, nil)
 	if err != nil {
@@ -16,7 +27,7 @@ func CheckCookieWeb(auth_url string, cookie *http.Cookie) (*AuthCookie, error) {
 		return nil, fmt.Errorf("could not create new auth check request, url: %s, error: %v", auth_url, err)
 	}
 
-	req.AddCookie(cookie)
+	prepare(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -34,6 +45,7 @@ func CheckCookieWeb(auth_url string, cookie *http.Cookie) (*AuthCookie, error) {
 	type AuthReply struct{
 		Operation		string		`json:"operation"`
 		Ac			AuthCookie	`json:"auth"`
+		Error			string		`json:"error"`
 	}
 
 	var reply AuthReply
@@ -44,5 +56,34 @@ func CheckCookieWeb(auth_url string, cookie *http.Cookie) (*AuthCookie, error) {
 		return nil, fmt.Errorf("could not decode reply: '%s', error: %v", string(body), err)
 	}
 
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+		return nil, &RejectError {
+			Status:		resp.StatusCode,
+			Reason:		reply.Error,
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth check has failed, url: %s, status: %d, error: %s", auth_url, resp.StatusCode, reply.Error)
+	}
+
+	if len(reply.Ac.Username) == 0 {
+		return nil, &RejectError {
+			Status:		resp.StatusCode,
+			Reason:		"empty username",
+		}
+	}
+
 	return &reply.Ac, nil
 }
+
+func CheckCookieWeb(auth_url string, cookie *http.Cookie) (*AuthCookie, error) {
+	return checkWeb(auth_url, func(req *http.Request) {
+		req.AddCookie(cookie)
+	})
+}
+
+func CheckTokenWeb(auth_url string, token string) (*AuthCookie, error) {
+	return checkWeb(auth_url, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer " + token)
+	})
+}
@@ -3,40 +3,139 @@ package auth
 import (
 	"encoding/gob"
 	"fmt"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 const CookieName string = "apparat"
 
+// cookie store and email token codecs are replaced when keyring is reloaded
+var cookieLock sync.RWMutex
 var cookieStore *sessions.CookieStore
-var cookieDuration int
 var cookiePath string
+var cookieDomain string
+var cookieSecure bool
+var cookieSameSite http.SameSite
+
+// cookie codecs reject cookies signed earlier than this
+const maxSessionLifetime time.Duration = 30 * 24 * time.Hour
+
+// absolute session lifetime, session can not be extended past it
+var sessionLifetime time.Duration = 7 * 24 * time.Hour
+// session expires if it has not been used for this long, 0 disables idle timeout
+var sessionIdle time.Duration
 
 type AuthCookie struct {
 	Username		string
 	Token			string
 	ExpiredAt		time.Time
+	Scopes			[]string
+	Roles			[]string
 }
 
+// InitCookieStore sets cookie keys, @cookie_keys are pairs of authentication and encryption keys,
+// the first pair is used to sign new cookies, the rest are only used to check existing ones.
+// Encryption key can be nil, the last one can be omitted.
 func InitCookieStore(cookie_keys [][]byte, cookie_path string) {
-	cookieStore = sessions.NewCookieStore(cookie_keys...)
 	gob.Register(&AuthCookie{})
 
-	cookieDuration = 3600 * 24 * 7
 	cookiePath = cookie_path
+	SetCookieKeys(cookie_keys)
+}
+
+// SetCookieAttributes sets attributes of every cookie issued by auth server,
+// SameSite=None is only accepted by browsers for secure cookies
+func SetCookieAttributes(domain string, secure bool, same_site http.SameSite) error {
+	if same_site == http.SameSiteNoneMode && !secure {
+		return fmt.Errorf("SameSite=None requires secure cookies")
+	}
+
+	cookieDomain = domain
+	cookieSecure = secure
+	cookieSameSite = same_site
+	return nil
+}
+
+func ParseSameSite(mode string) (http.SameSite, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, fmt.Errorf("invalid SameSite mode '%s', must be one of: lax, strict, none", mode)
+	}
+}
+
+// SetSessionTimeouts sets absolute session @lifetime and @idle timeout, the latter is disabled if 0
+func SetSessionTimeouts(lifetime, idle time.Duration) error {
+	if lifetime <= 0 || lifetime > maxSessionLifetime {
+		return fmt.Errorf("session lifetime must be positive and can not exceed %s", maxSessionLifetime)
+	}
+	if idle < 0 || idle > lifetime {
+		return fmt.Errorf("session idle timeout must be between 0 and session lifetime")
+	}
+
+	sessionLifetime = lifetime
+	sessionIdle = idle
+	return nil
+}
+
+// SetCookieKeys replaces cookie keys, cookies signed with keys which are not in the new list become invalid
+func SetCookieKeys(cookie_keys [][]byte) {
+	store := sessions.NewCookieStore(cookie_keys...)
+	codecs := securecookie.CodecsFromPairs(cookie_keys...)
+
+	cookieLock.Lock()
+	cookieStore = store
+	emailCodecs = codecs
+	cookieLock.Unlock()
+}
+
+func getCookieStore() *sessions.CookieStore {
+	cookieLock.RLock()
+	defer cookieLock.RUnlock()
+
+	return cookieStore
+}
+
+func getEmailCodecs() []securecookie.Codec {
+	cookieLock.RLock()
+	defer cookieLock.RUnlock()
+
+	return emailCodecs
+}
+
+func cookieOptions(max_age int) *sessions.Options {
+	return &sessions.Options {
+		Path:		cookiePath,
+		Domain:		cookieDomain,
+		MaxAge:		max_age,
+		Secure:		cookieSecure,
+		HttpOnly:	true,
+		SameSite:	cookieSameSite,
+	}
 }
 
 func NewAuthCookie(username string) *AuthCookie {
 	return &AuthCookie {
 		Username:	username,
-		ExpiredAt:	time.Now().Add(time.Second * time.Duration(cookieDuration)),
+		ExpiredAt:	time.Now().Add(sessionLifetime),
+		Scopes:		AllScopes,
+		Roles:		[]string{RoleUser},
 	}
 }
 
 func CheckAuthCookie(r *http.Request) (*AuthCookie, error) {
-	session, err := cookieStore.Get(r, CookieName)
+	session, err := getCookieStore().Get(r, CookieName)
 	if err != nil {
 		return nil, fmt.Errorf("could not read cookie: %v", err)
 	}
@@ -60,17 +159,56 @@ func CheckAuthCookie(r *http.Request) (*AuthCookie, error) {
 }
 
 func SetAuthCookie(r *http.Request, w http.ResponseWriter, ac *AuthCookie) error {
-	session, err := cookieStore.Get(r, CookieName)
+	session, err := getCookieStore().Get(r, CookieName)
 	if err != nil && session == nil {
 		return fmt.Errorf("could not read cookie: %v", err)
 	}
 
-	session.Options = &sessions.Options {
-		Path:		cookiePath,
-		MaxAge:		cookieDuration,
-		HttpOnly:	true,
+	max_age := int(time.Until(ac.ExpiredAt).Seconds())
+	if max_age <= 0 {
+		max_age = -1
 	}
+	session.Options = cookieOptions(max_age)
 
 	session.Values["auth"] = ac
 	return session.Save(r, w)
 }
+
+func ClearAuthCookie(r *http.Request, w http.ResponseWriter) error {
+	session, err := getCookieStore().Get(r, CookieName)
+	if err != nil && session == nil {
+		return fmt.Errorf("could not read cookie: %v", err)
+	}
+
+	session.Options = cookieOptions(-1)
+
+	delete(session.Values, "auth")
+	return session.Save(r, w)
+}
+
+// ResignAuthCookie signs auth cookie with the newest key if it has been signed with one of the older keys,
+// it does nothing if cookie is missing, invalid or cookie store has not been initialized
+func ResignAuthCookie(r *http.Request, w http.ResponseWriter) error {
+	store := getCookieStore()
+	if store == nil || len(store.Codecs) < 2 {
+		return nil
+	}
+
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil
+	}
+
+	values := make(map[interface{}]interface{})
+	err = securecookie.DecodeMulti(CookieName, cookie.Value, &values, store.Codecs[0])
+	if err == nil {
+		return nil
+	}
+
+	ac, err := CheckAuthCookie(r)
+	if err != nil {
+		return nil
+	}
+
+	return SetAuthCookie(r, w, ac)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"time"
+)
+
+const (
+	PurposeVerify string = "verify"
+	PurposeReset string = "reset"
+)
+
+const emailTokenName string = "apparat_email"
+
+// email tokens are signed with the same keys as cookies
+var emailCodecs []securecookie.Codec
+
+// EmailToken is sent to user as a signed string, its id is stored in database to make it single-use
+type EmailToken struct {
+	ID			string
+	Username		string
+	Purpose			string
+	Email			string
+	Created			time.Time
+	ExpiredAt		time.Time
+}
+
+func (ctl *AuthCtl) NewEmailToken(username, purpose, email string, ttl time.Duration) (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	et := &EmailToken {
+		ID:		id,
+		Username:	username,
+		Purpose:	purpose,
+		Email:		email,
+		Created:	time.Now(),
+	}
+	et.ExpiredAt = et.Created.Add(ttl)
+
+	token, err := securecookie.EncodeMulti(emailTokenName, et, getEmailCodecs()...)
+	if err != nil {
+		return "", fmt.Errorf("could not sign email token: %v", err)
+	}
+
+	err = ctl.store.CreateEmailToken(et)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// UseEmailToken checks token signature, purpose and expiration and marks it as used, every token can only be used once
+func (ctl *AuthCtl) UseEmailToken(token, purpose string) (*EmailToken, error) {
+	var et EmailToken
+
+	err := securecookie.DecodeMulti(emailTokenName, token, &et, getEmailCodecs()...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	if et.Purpose != purpose {
+		return nil, fmt.Errorf("invalid token purpose")
+	}
+	if time.Now().After(et.ExpiredAt) {
+		return nil, fmt.Errorf("expired token")
+	}
+
+	ok, err := ctl.store.UseEmailToken(et.ID, et.Username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("token has already been used")
+	}
+
+	return &et, nil
+}
+
+func (ctl *AuthCtl) EmailVerified(username string) (bool, error) {
+	return ctl.store.EmailVerified(username)
+}
+
+// VerifyEmail marks user's email as verified if it has not been changed since token was sent
+func (ctl *AuthCtl) VerifyEmail(username, email string) error {
+	ok, err := ctl.store.SetEmailVerified(username, email)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("email of user %s has been changed", username)
+	}
+
+	return nil
+}
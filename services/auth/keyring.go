@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// LoadKeyring reads cookie keys from file, every non-empty line which does not start with '#'
+// contains authentication key optionally followed by encryption key separated by whitespace.
+// The first line is the newest key which signs new cookies, the rest are only used to check existing cookies,
+// so rotation is done by adding new key at the top and removing the oldest one later.
+func LoadKeyring(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open keyring '%s': %v", path, err)
+	}
+	defer f.Close()
+
+	keys := make([][]byte, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 1:
+			keys = append(keys, []byte(fields[0]), nil)
+		case 2:
+			switch len(fields[1]) {
+			case 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("keyring '%s': line %d: encryption key must be 16, 24 or 32 bytes long", path, line)
+			}
+			keys = append(keys, []byte(fields[0]), []byte(fields[1]))
+		default:
+			return nil, fmt.Errorf("keyring '%s': line %d: expected authentication key and optional encryption key", path, line)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyring '%s': %v", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring '%s' does not contain any key", path)
+	}
+
+	return keys, nil
+}
+
+// CookieKeys returns cookie keys loaded from keyring if @keyring is not empty, otherwise single key pair from
+// @cookie_auth and @cookie_encrypt is returned, nil is returned if there are no keys at all
+func CookieKeys(keyring, cookie_auth, cookie_encrypt string) ([][]byte, error) {
+	if keyring != "" {
+		return LoadKeyring(keyring)
+	}
+
+	if cookie_auth == "" {
+		return nil, nil
+	}
+
+	cookie_keys := [][]byte{[]byte(cookie_auth)}
+	if cookie_encrypt != "" {
+		cookie_keys = append(cookie_keys, []byte(cookie_encrypt))
+	}
+
+	return cookie_keys, nil
+}
+
+// WatchKeyring reloads cookie keys from @path every time process receives SIGHUP,
+// current keys are kept if new keyring can not be loaded
+func WatchKeyring(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			keys, err := LoadKeyring(path)
+			if err != nil {
+				glog.Errorf("could not reload cookie keys, keeping the current ones: %v", err)
+				continue
+			}
+
+			SetCookieKeys(keys)
+			glog.Infof("reloaded %d cookie keys from keyring '%s'", len(keys) / 2, path)
+		}
+	}()
+}
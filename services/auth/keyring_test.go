@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	enc16 := "0123456789abcdef"
+	enc32 := "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name			string
+		data			string
+		keys			[][]byte
+	}{
+		{"single auth key", "auth1\n", [][]byte{[]byte("auth1"), nil}},
+		{"comments and empty lines", "# new key\n\n  auth2 " + enc32 + "\n# old key\nauth1\n",
+			[][]byte{[]byte("auth2"), []byte(enc32), []byte("auth1"), nil}},
+		{"tabs", "auth1\t" + enc16, [][]byte{[]byte("auth1"), []byte(enc16)}},
+		{"short encryption key", "auth1 short\n", nil},
+		{"too many fields", "auth1 " + enc16 + " extra\n", nil},
+		{"no keys", "# nothing here\n\n", nil},
+		{"empty", "", nil},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, "keyring" + string(rune('a' + i)))
+		err := os.WriteFile(path, []byte(test.data), 0600)
+		if err != nil {
+			t.Fatalf("could not write keyring: %v", err)
+		}
+
+		keys, err := LoadKeyring(path)
+		if test.keys == nil {
+			if err == nil {
+				t.Errorf("%s: invalid keyring has been accepted: %q", test.name, keys)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: could not load keyring: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: keys: %q, want: %q", test.name, keys, test.keys)
+		}
+	}
+
+	_, err := LoadKeyring(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Errorf("missing keyring has been accepted")
+	}
+}
+
+func TestCookieKeys(t *testing.T) {
+	tests := []struct {
+		auth			string
+		encrypt			string
+		keys			[][]byte
+	}{
+		{"", "", nil},
+		{"auth", "", [][]byte{[]byte("auth")}},
+		{"auth", "encrypt", [][]byte{[]byte("auth"), []byte("encrypt")}},
+	}
+
+	for _, test := range tests {
+		keys, err := CookieKeys("", test.auth, test.encrypt)
+		if err != nil {
+			t.Errorf("auth: %s, encrypt: %s: %v", test.auth, test.encrypt, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("auth: %s, encrypt: %s: keys: %q, want: %q", test.auth, test.encrypt, keys, test.keys)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"gopkg.in/ldap.v2"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// external identities of LDAP users are stored under this provider name, subject is the username
+const LDAPProvider string = "ldap"
+
+const ldapTimeout time.Duration = 10 * time.Second
+
+type LDAPConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	URL			string
+	StartTLS		bool
+	InsecureSkipVerify	bool
+
+	// user DN template, like 'uid=%s,ou=people,dc=example,dc=com', '%s' is replaced with escaped username
+	UserDN			string
+	NameAttr		string
+	EmailAttr		string
+
+	// groups are searched under @GroupBase with @GroupFilter where '%s' is replaced with escaped user DN,
+	// group search is disabled if @GroupRoles is empty
+	GroupBase		string
+	GroupFilter		string
+	GroupAttr		string
+	// maps group name (value of @GroupAttr) to role, users who are not members of any mapped group get RoleUser
+	GroupRoles		map[string]string
+}
+
+type LDAPAuth struct {
+	config			LDAPConfig
+}
+
+func NewLDAPAuth(config LDAPConfig) (*LDAPAuth, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL '%s': %v", config.URL, err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("invalid LDAP URL '%s': scheme must be either ldap or ldaps", config.URL)
+	}
+	if strings.Count(config.UserDN, "%s") != 1 {
+		return nil, fmt.Errorf("invalid LDAP user DN template '%s': it must contain exactly one '%%s'", config.UserDN)
+	}
+
+	for group, role := range config.GroupRoles {
+		if !HasRole(AllRoles, role) {
+			return nil, fmt.Errorf("invalid role '%s' for LDAP group '%s', allowed roles: %v", role, group, AllRoles)
+		}
+	}
+	if len(config.GroupRoles) != 0 {
+		if config.GroupBase == "" {
+			return nil, fmt.Errorf("LDAP group base must be set if group to role mapping is used")
+		}
+		if strings.Count(config.GroupFilter, "%s") != 1 {
+			return nil, fmt.Errorf("invalid LDAP group filter '%s': it must contain exactly one '%%s'", config.GroupFilter)
+		}
+	}
+
+	return &LDAPAuth {
+		config:		config,
+	}, nil
+}
+
+// escapeDN escapes special characters of the attribute value according to RFC 4514
+func escapeDN(value string) string {
+	var b bytes.Buffer
+
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", ch) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch == '#' && i == 0, ch == ' ' && (i == 0 || i == len(value) - 1):
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch < ' ':
+			fmt.Fprintf(&b, "\\%02x", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+
+	return b.String()
+}
+
+func (la *LDAPAuth) dial() (*ldap.Conn, error) {
+	u, _ := url.Parse(la.config.URL)
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	tls_config := &tls.Config {
+		ServerName:		u.Hostname(),
+		InsecureSkipVerify:	la.config.InsecureSkipVerify,
+	}
+
+	var conn *ldap.Conn
+	var err error
+	if u.Scheme == "ldaps" {
+		conn, err = ldap.DialTLS("tcp", host, tls_config)
+	} else {
+		conn, err = ldap.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LDAP server '%s': %v", la.config.URL, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if la.config.StartTLS && u.Scheme == "ldap" {
+		err = conn.StartTLS(tls_config)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start TLS with LDAP server '%s': %v", la.config.URL, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// Authenticate binds as the user with given password and returns user data and roles from the directory,
+// roles are nil if group to role mapping is not configured
+func (la *LDAPAuth) Authenticate(username, password string) (*Mailbox, error) {
+	// empty password would be an unauthenticated bind which always succeeds
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("invalid LDAP credentials")
+	}
+
+	conn, err := la.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dn := fmt.Sprintf(la.config.UserDN, escapeDN(username))
+	err = conn.Bind(dn, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("invalid LDAP credentials")
+		}
+		return nil, fmt.Errorf("could not bind to LDAP server as '%s': %v", dn, err)
+	}
+
+	mbox := &Mailbox {
+		Username:	username,
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		"(objectClass=*)", []string{la.config.NameAttr, la.config.EmailAttr}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("could not read LDAP entry '%s': %v", dn, err)
+	}
+	if len(res.Entries) != 0 {
+		mbox.Realname = res.Entries[0].GetAttributeValue(la.config.NameAttr)
+		mbox.Email = res.Entries[0].GetAttributeValue(la.config.EmailAttr)
+	}
+
+	if len(la.config.GroupRoles) == 0 {
+		return mbox, nil
+	}
+
+	res, err = conn.Search(ldap.NewSearchRequest(la.config.GroupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(la.config.GroupFilter, ldap.EscapeFilter(dn)), []string{la.config.GroupAttr}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("could not search LDAP groups of '%s': %v", dn, err)
+	}
+
+	mbox.Roles = make([]string, 0)
+	for _, e := range res.Entries {
+		for _, group := range e.GetAttributeValues(la.config.GroupAttr) {
+			role, ok := la.config.GroupRoles[group]
+			if ok && !HasRole(mbox.Roles, role) {
+				mbox.Roles = append(mbox.Roles, role)
+			}
+		}
+	}
+	if len(mbox.Roles) == 0 {
+		mbox.Roles = []string{RoleUser}
+	}
+
+	return mbox, nil
+}
+
+func (ctl *AuthCtl) SetLDAP(la *LDAPAuth) {
+	ctl.ldap = la
+}
+
+// ldapUser creates local user for LDAP user on the first login and syncs its data and roles on every next login
+func (ctl *AuthCtl) ldapUser(entry *Mailbox) error {
+	username, err := ctl.store.IdentityUser(LDAPProvider, entry.Username)
+	if err != nil {
+		return err
+	}
+
+	mbox := &Mailbox {
+		Username:	entry.Username,
+	}
+
+	if username == "" {
+		err = ctl.LookupUser(mbox)
+		if err == nil {
+			return fmt.Errorf("local user %s already exists and is not linked to LDAP", entry.Username)
+		}
+
+		// LDAP users can not login with local password, so it is just a random string
+		password, err := randomHex(32)
+		if err != nil {
+			return err
+		}
+
+		mbox.Password = password
+		mbox.Realname = entry.Realname
+		mbox.Email = entry.Email
+		mbox.Roles = entry.Roles
+
+		err = ctl.NewUser(mbox)
+		if err != nil {
+			return err
+		}
+
+		glog.Infof("ldap: created local user %s", mbox.String())
+		return ctl.store.CreateIdentity(LDAPProvider, entry.Username, mbox.Username)
+	}
+
+	err = ctl.LookupUser(mbox)
+	if err != nil {
+		return err
+	}
+
+	if entry.Realname != mbox.Realname || entry.Email != mbox.Email {
+		mbox.Realname = entry.Realname
+		mbox.Email = entry.Email
+
+		err = ctl.UpdateUser(mbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	if entry.Roles != nil {
+		err = ctl.store.SetRoles(mbox.Username, entry.Roles)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CanChangePassword returns error if password of the user is checked against LDAP directory,
+// local password of such user is never used, so it can not be changed or reset
+func (ctl *AuthCtl) CanChangePassword(username string) error {
+	if ctl.ldap == nil {
+		return nil
+	}
+
+	linked, err := ctl.store.IdentityUser(LDAPProvider, username)
+	if err != nil {
+		return err
+	}
+	if linked != "" {
+		return fmt.Errorf("password of user %s is managed by LDAP directory and can not be changed here", username)
+	}
+
+	return nil
+}
+
+// Login checks user credentials, if LDAP is configured users linked to LDAP are only authenticated against directory,
+// local users which are not linked to LDAP keep using local passwords
+func (ctl *AuthCtl) Login(mbox *Mailbox) error {
+	if ctl.ldap == nil {
+		return ctl.GetUser(mbox)
+	}
+
+	entry, ldap_err := ctl.ldap.Authenticate(mbox.Username, mbox.Password)
+	if ldap_err == nil {
+		err := ctl.ldapUser(entry)
+		if err != nil {
+			return err
+		}
+
+		_, err = ctl.readUser(mbox)
+		if err != nil {
+			return err
+		}
+		if mbox.Disabled {
+			return fmt.Errorf("account %s is disabled", mbox.Username)
+		}
+
+		return nil
+	}
+
+	username, err := ctl.store.IdentityUser(LDAPProvider, mbox.Username)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		return ldap_err
+	}
+
+	return ctl.GetUser(mbox)
+}
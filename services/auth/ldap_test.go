@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testEntry struct {
+	dn			string
+	attrs			map[string][]string
+}
+
+// testDirectory is a stand-in LDAP server, it only supports simple bind, base object search of the entries
+// and '(member=dn)' search of the groups
+type testDirectory struct {
+	listener		net.Listener
+	passwords		map[string]string
+
+	sync.Mutex
+	entries			[]testEntry
+	groups			[]testEntry
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	dir := &testDirectory {
+		listener:	l,
+		passwords:	make(map[string]string),
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go dir.serve(conn)
+		}
+	}()
+
+	return dir
+}
+
+func (dir *testDirectory) URL() string {
+	return "ldap://" + dir.listener.Addr().String()
+}
+
+func ldapResult(id int64, tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(res)
+	return p
+}
+
+func ldapEntry(id int64, e *testEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	res.AppendChild(attrs)
+	p.AppendChild(res)
+	return p
+}
+
+func (dir *testDirectory) search(base string, scope int64, filter string) []testEntry {
+	dir.Lock()
+	defer dir.Unlock()
+
+	found := make([]testEntry, 0)
+	if scope == ldap.ScopeBaseObject {
+		for _, e := range dir.entries {
+			if e.dn == base {
+				found = append(found, e)
+			}
+		}
+		return found
+	}
+
+	member := strings.TrimSuffix(strings.TrimPrefix(filter, "(member="), ")")
+	for _, g := range dir.groups {
+		if strings.HasSuffix(g.dn, base) {
+			for _, m := range g.attrs["member"] {
+				if m == member {
+					found = append(found, g)
+				}
+			}
+		}
+	}
+	return found
+}
+
+func (dir *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			code := ldap.LDAPResultSuccess
+			if want, ok := dir.passwords[dn]; !ok || want != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base, _ := op.Children[0].Value.(string)
+			scope, _ := op.Children[1].Value.(int64)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+
+			for _, e := range dir.search(base, scope, filter) {
+				conn.Write(ldapEntry(id, &e).Bytes())
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func newTestLDAPCtl(t *testing.T) (*AuthCtl, *testDirectory) {
+	dir := newTestDirectory(t)
+	dir.passwords["uid=alice,ou=people,dc=example,dc=com"] = "alice-password"
+	dir.passwords["uid=bob,ou=people,dc=example,dc=com"] = "bob-password"
+	dir.entries = []testEntry {
+		{"uid=alice,ou=people,dc=example,dc=com", map[string][]string{"cn": {"Alice"}, "mail": {"alice@example.com"}}},
+		{"uid=bob,ou=people,dc=example,dc=com", map[string][]string{"cn": {"Bob"}}},
+	}
+	dir.groups = []testEntry {
+		{"cn=admins,ou=groups,dc=example,dc=com", map[string][]string {
+			"cn":		{"admins"},
+			"member":	{"uid=alice,ou=people,dc=example,dc=com"},
+		}},
+		{"cn=readers,ou=groups,dc=example,dc=com", map[string][]string {
+			"cn":		{"readers"},
+			"member":	{"uid=alice,ou=people,dc=example,dc=com"},
+		}},
+		{"cn=unmapped,ou=groups,dc=example,dc=com", map[string][]string {
+			"cn":		{"unmapped"},
+			"member":	{"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+		}},
+	}
+
+	la, err := NewLDAPAuth(LDAPConfig {
+		URL:		dir.URL(),
+		UserDN:		"uid=%s,ou=people,dc=example,dc=com",
+		NameAttr:	"cn",
+		EmailAttr:	"mail",
+		GroupBase:	"ou=groups,dc=example,dc=com",
+		GroupFilter:	"(member=%s)",
+		GroupAttr:	"cn",
+		GroupRoles:	map[string]string{"admins": RoleAdmin, "readers": RoleReadOnly},
+	})
+	if err != nil {
+		t.Fatalf("could not create LDAP authentication: %v", err)
+	}
+
+	ctl := newTestCtl(t)
+	ctl.SetLDAP(la)
+	return ctl, dir
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	ctl, _ := newTestLDAPCtl(t)
+
+	tests := []struct {
+		username		string
+		password		string
+		ok			bool
+		realname		string
+		email			string
+		roles			[]string
+	}{
+		{"alice", "alice-password", true, "Alice", "alice@example.com", []string{RoleAdmin, RoleReadOnly}},
+		{"bob", "bob-password", true, "Bob", "", []string{RoleUser}},
+		{"alice", "wrong", false, "", "", nil},
+		{"alice", "", false, "", "", nil},
+		{"carol", "alice-password", false, "", "", nil},
+	}
+
+	for _, test := range tests {
+		mbox, err := ctl.ldap.Authenticate(test.username, test.password)
+		if (err == nil) != test.ok {
+			t.Errorf("%s/%s: error: %v, must succeed: %v", test.username, test.password, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if mbox.Realname != test.realname || mbox.Email != test.email || !reflect.DeepEqual(mbox.Roles, test.roles) {
+			t.Errorf("%s: realname: %s, email: %s, roles: %v, want: %s, %s, %v",
+				test.username, mbox.Realname, mbox.Email, mbox.Roles, test.realname, test.email, test.roles)
+		}
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	ctl, dir := newTestLDAPCtl(t)
+	newTestUser(t, ctl, "local", "local-password")
+
+	login := func(username, password string) (*Mailbox, error) {
+		mbox := &Mailbox {
+			Username:	username,
+			Password:	password,
+		}
+		err := ctl.Login(mbox)
+		return mbox, err
+	}
+
+	mbox, err := login("alice", "alice-password")
+	if err != nil {
+		t.Fatalf("could not login: %v", err)
+	}
+	if mbox.Realname != "Alice" || !reflect.DeepEqual(mbox.Roles, []string{RoleAdmin, RoleReadOnly}) {
+		t.Errorf("provisioned user: realname: %s, roles: %v", mbox.Realname, mbox.Roles)
+	}
+
+	_, err = login("alice", "wrong")
+	if err == nil {
+		t.Errorf("login with wrong LDAP password has been accepted")
+	}
+
+	// roles are synced from groups on every login
+	dir.Lock()
+	dir.groups = dir.groups[1:]
+	dir.Unlock()
+	mbox, err = login("alice", "alice-password")
+	if err != nil {
+		t.Fatalf("could not login: %v", err)
+	}
+	if !reflect.DeepEqual(mbox.Roles, []string{RoleReadOnly}) {
+		t.Errorf("roles after leaving admins group: %v", mbox.Roles)
+	}
+
+	_, err = login("local", "local-password")
+	if err != nil {
+		t.Errorf("local user could not login: %v", err)
+	}
+
+	// local password of LDAP user is never checked, so it can not be changed
+	err = ctl.CanChangePassword("alice")
+	if err == nil {
+		t.Errorf("password change of LDAP user has been allowed")
+	}
+	err = ctl.UpdateUser(&Mailbox{Username: "alice", Realname: "Alice", Email: "alice@example.com", Password: "new-password"})
+	if err == nil {
+		t.Errorf("password of LDAP user has been changed")
+	}
+
+	err = ctl.CanChangePassword("local")
+	if err != nil {
+		t.Errorf("password change of local user has been refused: %v", err)
+	}
+	err = ctl.UpdateUser(&Mailbox{Username: "local", Email: "local@example.com", Password: "new-password"})
+	if err != nil {
+		t.Errorf("could not change password of local user: %v", err)
+	}
+}
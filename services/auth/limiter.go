@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backoff delay between failed attempts never exceeds this value, lockout can be longer
+const maxBackoff time.Duration = 5 * time.Minute
+
+// limiter forgets about keys if there were no failures for this long
+const limiterForget time.Duration = 24 * time.Hour
+
+const limiterCleanupSize int = 100000
+
+type attempts struct {
+	failures		int
+	last			time.Time
+	locked_until		time.Time
+}
+
+type Lockout struct {
+	Key			string		`json:"key"`
+	Failures		int		`json:"failures"`
+	LastFailure		time.Time	`json:"last_failure"`
+	LockedUntil		time.Time	`json:"locked_until"`
+	RetryAfter		time.Time	`json:"retry_after"`
+}
+
+// Limiter tracks failed attempts per key (like username or client address),
+// after @free failures every next attempt has to wait exponentially growing delay,
+// after @lock_after failures key is locked out for @lockout interval
+type Limiter struct {
+	free			int
+	lock_after		int
+	lockout			time.Duration
+
+	sync.Mutex
+	entries			map[string]*attempts
+}
+
+func NewLimiter(free, lock_after int, lockout time.Duration) *Limiter {
+	return &Limiter {
+		free:		free,
+		lock_after:	lock_after,
+		lockout:	lockout,
+		entries:	make(map[string]*attempts),
+	}
+}
+
+func (l *Limiter) retryAfter(a *attempts) time.Time {
+	if a.locked_until.After(a.last) {
+		return a.locked_until
+	}
+
+	if a.failures <= l.free {
+		return a.last
+	}
+
+	delay := time.Second
+	for i := l.free + 1; i < a.failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return a.last.Add(delay)
+}
+
+// Check returns error if there were too many failed attempts for the given key and caller has to wait
+func (l *Limiter) Check(key string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	a, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Before(a.locked_until) {
+		return fmt.Errorf("%s is locked out after %d failed attempts until %s", key, a.failures, a.locked_until.Format(time.RFC3339))
+	}
+
+	retry := l.retryAfter(a)
+	if now.Before(retry) {
+		return fmt.Errorf("%s has %d failed attempts, retry after %s", key, a.failures, retry.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (l *Limiter) Fail(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+
+	if len(l.entries) >= limiterCleanupSize {
+		for k, a := range l.entries {
+			if now.Sub(a.last) > limiterForget && now.After(a.locked_until) {
+				delete(l.entries, k)
+			}
+		}
+	}
+
+	a, ok := l.entries[key]
+	if !ok || now.Sub(a.last) > limiterForget {
+		a = &attempts{}
+		l.entries[key] = a
+	}
+
+	a.failures++
+	a.last = now
+
+	if l.lock_after > 0 && a.failures >= l.lock_after && a.failures % l.lock_after == 0 {
+		a.locked_until = now.Add(l.lockout)
+	}
+}
+
+func (l *Limiter) Success(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.entries, key)
+}
+
+// Clear removes failed attempts history for the key, returns false if there was nothing to clear
+func (l *Limiter) Clear(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+// Lockouts returns all keys which currently have to wait before the next attempt
+func (l *Limiter) Lockouts() []Lockout {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	ret := make([]Lockout, 0)
+	for k, a := range l.entries {
+		retry := l.retryAfter(a)
+		if !now.Before(retry) {
+			continue
+		}
+
+		ret = append(ret, Lockout {
+			Key:		k,
+			Failures:	a.failures,
+			LastFailure:	a.last,
+			LockedUntil:	a.locked_until,
+			RetryAfter:	retry,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+func UserLimiterKey(username string) string {
+	return "user:" + username
+}
+
+func ClientLimiterKey(addr string) string {
+	return "ip:" + addr
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(3, 0, time.Hour)
+	last := time.Unix(1000000, 0)
+
+	tests := []struct {
+		failures		int
+		delay			time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{11, 128 * time.Second},
+		{12, 256 * time.Second},
+		{13, maxBackoff},
+		{100, maxBackoff},
+	}
+
+	for _, test := range tests {
+		retry := l.retryAfter(&attempts {
+			failures:	test.failures,
+			last:		last,
+		})
+
+		if delay := retry.Sub(last); delay != test.delay {
+			t.Errorf("failures: %d: delay: %s, want: %s", test.failures, delay, test.delay)
+		}
+	}
+}
+
+func TestLimiterCheck(t *testing.T) {
+	l := NewLimiter(2, 5, time.Hour)
+	key := UserLimiterKey("alice")
+
+	// every failure is recorded in the past, so that backoff delay has already passed, only lockout is left
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			l.Fail(key)
+			l.entries[key].last = time.Now().Add(-maxBackoff)
+		}
+	}
+
+	tests := []struct {
+		failures		int
+		locked			bool
+	}{
+		{1, false},
+		{2, false},
+		{4, false},
+		{5, true},
+		{6, true},
+	}
+
+	done := 0
+	for _, test := range tests {
+		fail(test.failures - done)
+		done = test.failures
+
+		err := l.Check(key)
+		if (err != nil) != test.locked {
+			t.Errorf("failures: %d: error: %v, must be locked: %v", test.failures, err, test.locked)
+		}
+	}
+
+	if len(l.Lockouts()) != 1 {
+		t.Errorf("lockouts: %v, want single key %s", l.Lockouts(), key)
+	}
+
+	// lockout expires
+	l.entries[key].locked_until = time.Now().Add(-time.Second)
+	err := l.Check(key)
+	if err != nil {
+		t.Errorf("lockout has expired, but key is still locked: %v", err)
+	}
+
+	// the next failure after free attempts has to wait
+	l.Fail(key)
+	err = l.Check(key)
+	if err == nil {
+		t.Errorf("failure %d has not been delayed", done + 1)
+	}
+
+	l.Success(key)
+	err = l.Check(key)
+	if err != nil {
+		t.Errorf("successful attempt has not reset failures: %v", err)
+	}
+	if l.Clear(key) {
+		t.Errorf("successful attempt has not removed key")
+	}
+
+	err = l.Check(ClientLimiterKey("127.0.0.1"))
+	if err != nil {
+		t.Errorf("unknown key has been limited: %v", err)
+	}
+}
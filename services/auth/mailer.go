@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type SMTPMailer struct {
+	Addr			string
+	From			string
+	Username		string
+	Password		string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.From, to, subject, time.Now().Format(time.RFC1123Z), body)
+
+	var sauth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid smtp address '%s': %v", m.Addr, err)
+		}
+
+		sauth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	err := smtp.SendMail(m.Addr, sauth, m.From, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("could not send mail to %s via %s: %v", to, m.Addr, err)
+	}
+
+	return nil
+}
+
+// LogMailer does not send anything, messages are appended to the file or written into log if path is empty
+type LogMailer struct {
+	Path			string
+
+	sync.Mutex
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	if m.Path == "" {
+		glog.Infof("mail: to: %s, subject: %s, body: %s", to, subject, body)
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open mail log '%s': %v", m.Path, err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), to, subject, body)
+	if err != nil {
+		return fmt.Errorf("could not write mail log '%s': %v", m.Path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const OIDCCookieName string = "apparat_oidc"
+
+// login has to be finished within this interval after redirect to identity provider
+const oidcLoginTimeout time.Duration = 10 * time.Minute
+
+// OIDCLogin is stored in a separate short-lived cookie between redirect to identity provider and callback
+type OIDCLogin struct {
+	State			string
+	Verifier		string
+	Nonce			string
+	ExpiredAt		time.Time
+}
+
+type OIDCIdentity struct {
+	Provider		string
+	Subject			string
+	// empty if provider has not verified the address
+	Email			string
+	Name			string
+	PreferredUsername	string
+}
+
+type OIDCProvider struct {
+	Name			string
+
+	provider		*oidc.Provider
+	verifier		*oidc.IDTokenVerifier
+	config			oauth2.Config
+}
+
+func NewOIDCProvider(name, issuer, client_id, client_secret, redirect_url string) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC provider '%s': %v", issuer, err)
+	}
+
+	gob.Register(&OIDCLogin{})
+
+	p := &OIDCProvider {
+		Name:		name,
+		provider:	provider,
+		verifier:	provider.Verifier(&oidc.Config {
+			ClientID:	client_id,
+		}),
+		config:		oauth2.Config {
+			ClientID:	client_id,
+			ClientSecret:	client_secret,
+			RedirectURL:	redirect_url,
+			Endpoint:	provider.Endpoint(),
+			Scopes:		[]string{oidc.ScopeOpenID, "profile", "email"},
+		},
+	}
+
+	return p, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// StartLogin stores state, nonce and PKCE verifier in a cookie and returns identity provider URL to redirect user to
+func (p *OIDCProvider) StartLogin(r *http.Request, w http.ResponseWriter) (string, error) {
+	var err error
+	login := &OIDCLogin {
+		ExpiredAt:	time.Now().Add(oidcLoginTimeout),
+	}
+
+	login.State, err = randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	login.Nonce, err = randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	login.Verifier, err = randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := getCookieStore().Get(r, OIDCCookieName)
+	if err != nil && session == nil {
+		return "", fmt.Errorf("could not read cookie: %v", err)
+	}
+	session.Options = cookieOptions(int(oidcLoginTimeout.Seconds()))
+	session.Values["login"] = login
+	err = session.Save(r, w)
+	if err != nil {
+		return "", fmt.Errorf("could not save login state: %v", err)
+	}
+
+	url := p.config.AuthCodeURL(login.State,
+		oidc.Nonce(login.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(login.Verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	return url, nil
+}
+
+// FinishLogin handles identity provider callback: checks state, exchanges code and verifies ID token
+func (p *OIDCProvider) FinishLogin(r *http.Request, w http.ResponseWriter) (*OIDCIdentity, error) {
+	session, err := getCookieStore().Get(r, OIDCCookieName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read login state cookie: %v", err)
+	}
+
+	login, ok := session.Values["login"].(*OIDCLogin)
+	if !ok {
+		return nil, fmt.Errorf("there is no login in progress")
+	}
+
+	// login state is single-use
+	session.Options = cookieOptions(-1)
+	delete(session.Values, "login")
+	session.Save(r, w)
+
+	if time.Now().After(login.ExpiredAt) {
+		return nil, fmt.Errorf("login has expired")
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		return nil, fmt.Errorf("identity provider returned error: %s: %s", e, r.URL.Query().Get("error_description"))
+	}
+
+	if r.URL.Query().Get("state") != login.State {
+		return nil, fmt.Errorf("state mismatch")
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("there is no authorization code in callback")
+	}
+
+	ctx := context.Background()
+	token, err := p.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", login.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange authorization code: %v", err)
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response does not contain id_token")
+	}
+
+	id_token, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify id_token: %v", err)
+	}
+
+	if id_token.Nonce != login.Nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+
+	var claims struct {
+		Email			string		`json:"email"`
+		EmailVerified		bool		`json:"email_verified"`
+		Name			string		`json:"name"`
+		PreferredUsername	string		`json:"preferred_username"`
+	}
+	err = id_token.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse id_token claims: %v", err)
+	}
+
+	id := &OIDCIdentity {
+		Provider:		p.Name,
+		Subject:		id_token.Subject,
+		Name:			claims.Name,
+		PreferredUsername:	claims.PreferredUsername,
+	}
+	// provider may return address which user has not proven to own, such email can not be trusted for password reset
+	if claims.EmailVerified {
+		id.Email = claims.Email
+	}
+	return id, nil
+}
+
+var usernameCleaner = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+func (id *OIDCIdentity) username() string {
+	name := id.PreferredUsername
+	if name == "" {
+		name = strings.SplitN(id.Email, "@", 2)[0]
+	}
+
+	name = usernameCleaner.ReplaceAllString(name, "")
+	if name == "" {
+		name = id.Provider
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
+
+// ExternalUser returns local user linked to external identity, local user is created on the first login
+func (ctl *AuthCtl) ExternalUser(id *OIDCIdentity) (*Mailbox, error) {
+	username, err := ctl.store.IdentityUser(id.Provider, id.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" {
+		mbox := &Mailbox {
+			Username:	username,
+		}
+
+		err = ctl.LookupUser(mbox)
+		if err != nil {
+			return nil, err
+		}
+
+		return mbox, nil
+	}
+
+	// external users can not login with password until they reset it, so it is just a random string
+	password, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox := &Mailbox {
+		Username:	id.username(),
+		Password:	password,
+		Realname:	id.Name,
+		Email:		id.Email,
+	}
+
+	err = ctl.NewUser(mbox)
+	if err != nil {
+		// username is already taken, make it unique using identity subject
+		sum := sha256.Sum256([]byte(id.Provider + "\x00" + id.Subject))
+		mbox.Username = fmt.Sprintf("%s-%x", id.username(), sum[:4])
+
+		err = ctl.NewUser(mbox)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = ctl.store.CreateIdentity(id.Provider, id.Subject, mbox.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.Password = ""
+	return mbox, nil
+}
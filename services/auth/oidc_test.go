@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a stand-in identity provider, it serves discovery, JWKS and token endpoints,
+// authorization codes are issued by the test itself with authorize()
+type testIdP struct {
+	server			*httptest.Server
+	key			*rsa.PrivateKey
+
+	sync.Mutex
+	// code -> authorization request parameters and claims of the ID token to issue
+	codes			map[string]*testAuthorization
+}
+
+type testAuthorization struct {
+	challenge		string
+	claims			map[string]interface{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate signing key: %v", err)
+	}
+
+	idp := &testIdP {
+		key:		key,
+		codes:		make(map[string]*testAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"issuer":				idp.server.URL,
+			"authorization_endpoint":		idp.server.URL + "/authorize",
+			"token_endpoint":			idp.server.URL + "/token",
+			"jwks_uri":				idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported":	[]string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"keys": []map[string]string {
+				{
+					"kty":	"RSA",
+					"alg":	"RS256",
+					"use":	"sig",
+					"kid":	"test",
+					"n":	base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":	base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.Lock()
+		a, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.Unlock()
+
+		if !ok || pkceChallenge(r.FormValue("code_verifier")) != a.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{} {
+			"access_token":		"access",
+			"token_type":		"Bearer",
+			"expires_in":		3600,
+			"id_token":		idp.sign(t, a.claims),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("could not pack token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	data := enc(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize plays user who has logged in at identity provider, it returns authorization code
+// for the request made by StartLogin(), @claims override default ID token claims
+func (idp *testIdP) authorize(t *testing.T, auth_url string, claims map[string]interface{}) string {
+	u, err := url.Parse(auth_url)
+	if err != nil {
+		t.Fatalf("invalid authorization URL '%s': %v", auth_url, err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request does not use PKCE: %s", auth_url)
+	}
+
+	now := time.Now()
+	a := &testAuthorization {
+		challenge:	q.Get("code_challenge"),
+		claims:		map[string]interface{} {
+			"iss":		idp.server.URL,
+			"aud":		q.Get("client_id"),
+			"sub":		"subject",
+			"nonce":	q.Get("nonce"),
+			"iat":		now.Unix(),
+			"exp":		now.Add(time.Hour).Unix(),
+		},
+	}
+	for k, v := range claims {
+		a.claims[k] = v
+	}
+
+	code, err := randomHex(8)
+	if err != nil {
+		t.Fatalf("could not generate code: %v", err)
+	}
+
+	idp.Lock()
+	idp.codes[code] = a
+	idp.Unlock()
+	return code
+}
+
+// startLogin returns identity provider URL and cookies set by StartLogin()
+func startLogin(t *testing.T, p *OIDCProvider) (string, []*http.Cookie) {
+	w := httptest.NewRecorder()
+	auth_url, err := p.StartLogin(httptest.NewRequest("GET", "/oidc/login", nil), w)
+	if err != nil {
+		t.Fatalf("could not start login: %v", err)
+	}
+
+	return auth_url, w.Result().Cookies()
+}
+
+func finishLogin(p *OIDCProvider, cookies []*http.Cookie, state, code string) (*OIDCIdentity, error) {
+	r := httptest.NewRequest("GET", "/oidc/callback?state=" + url.QueryEscape(state) + "&code=" + url.QueryEscape(code), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	return p.FinishLogin(r, httptest.NewRecorder())
+}
+
+func TestOIDCLogin(t *testing.T) {
+	InitCookieStore([][]byte{[]byte("test-auth-key")}, "/")
+
+	idp := newTestIdP(t)
+	p, err := NewOIDCProvider("test", idp.server.URL, "client", "secret", "http://apparat/oidc/callback")
+	if err != nil {
+		t.Fatalf("could not create OIDC provider: %v", err)
+	}
+
+	state := func(auth_url string) string {
+		u, _ := url.Parse(auth_url)
+		return u.Query().Get("state")
+	}
+
+	tests := []struct {
+		name			string
+		finish			func() (*OIDCIdentity, error)
+		ok			bool
+	}{
+		{"valid login", func() (*OIDCIdentity, error) {
+			auth_url, cookies := startLogin(t, p)
+			code := idp.authorize(t, auth_url, map[string]interface{}{"email": "alice@example.com", "email_verified": true})
+			return finishLogin(p, cookies, state(auth_url), code)
+		}, true},
+		{"state mismatch", func() (*OIDCIdentity, error) {
+			auth_url, cookies := startLogin(t, p)
+			code := idp.authorize(t, auth_url, nil)
+			return finishLogin(p, cookies, state(auth_url) + "0", code)
+		}, false},
+		{"callback without login state", func() (*OIDCIdentity, error) {
+			auth_url, _ := startLogin(t, p)
+			code := idp.authorize(t, auth_url, nil)
+			return finishLogin(p, nil, state(auth_url), code)
+		}, false},
+		{"nonce mismatch", func() (*OIDCIdentity, error) {
+			auth_url, cookies := startLogin(t, p)
+			code := idp.authorize(t, auth_url, map[string]interface{}{"nonce": "other"})
+			return finishLogin(p, cookies, state(auth_url), code)
+		}, false},
+		{"missing nonce", func() (*OIDCIdentity, error) {
+			auth_url, cookies := startLogin(t, p)
+			code := idp.authorize(t, auth_url, map[string]interface{}{"nonce": ""})
+			return finishLogin(p, cookies, state(auth_url), code)
+		}, false},
+		{"code issued for another login", func() (*OIDCIdentity, error) {
+			// state of the first login is valid, but its PKCE verifier does not match challenge the code was issued for
+			auth_url, cookies := startLogin(t, p)
+			other_url, _ := startLogin(t, p)
+			code := idp.authorize(t, other_url, nil)
+			return finishLogin(p, cookies, state(auth_url), code)
+		}, false},
+		{"foreign audience", func() (*OIDCIdentity, error) {
+			auth_url, cookies := startLogin(t, p)
+			code := idp.authorize(t, auth_url, map[string]interface{}{"aud": "other-client"})
+			return finishLogin(p, cookies, state(auth_url), code)
+		}, false},
+	}
+
+	for _, test := range tests {
+		id, err := test.finish()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error: %v, must succeed: %v", test.name, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if id.Provider != "test" || id.Subject != "subject" || id.Email != "alice@example.com" {
+			t.Errorf("%s: identity: %+v", test.name, id)
+		}
+	}
+
+	// address which provider has not verified is not trusted
+	auth_url, cookies := startLogin(t, p)
+	code := idp.authorize(t, auth_url, map[string]interface{}{"email": "alice@example.com", "email_verified": false})
+	id, err := finishLogin(p, cookies, state(auth_url), code)
+	if err != nil {
+		t.Fatalf("could not login: %v", err)
+	}
+	if id.Email != "" {
+		t.Errorf("unverified email has been accepted: %s", id.Email)
+	}
+}
+
+func TestExternalUser(t *testing.T) {
+	ctl := newTestCtl(t)
+	newTestUser(t, ctl, "alice", "password")
+
+	suffix := func(id *OIDCIdentity) string {
+		sum := sha256.Sum256([]byte(id.Provider + "\x00" + id.Subject))
+		return fmt.Sprintf("%x", sum[:4])
+	}
+
+	tests := []struct {
+		id			*OIDCIdentity
+		username		string
+	}{
+		{&OIDCIdentity{Provider: "test", Subject: "s1", PreferredUsername: "bob"}, "bob"},
+		// repeated login of the same identity gets the same user even if its preferred username has changed
+		{&OIDCIdentity{Provider: "test", Subject: "s1", PreferredUsername: "robert"}, "bob"},
+		{&OIDCIdentity{Provider: "test", Subject: "s2", PreferredUsername: "alice"}, "alice-"},
+		{&OIDCIdentity{Provider: "test", Subject: "s3", PreferredUsername: "alice"}, "alice-"},
+		{&OIDCIdentity{Provider: "other", Subject: "s2", Email: "alice@example.org"}, "alice-"},
+		{&OIDCIdentity{Provider: "test", Subject: "s4", PreferredUsername: "carol smith!"}, "carolsmith"},
+		{&OIDCIdentity{Provider: "test", Subject: "s5"}, "test"},
+	}
+
+	users := make(map[string]string)
+	for _, test := range tests {
+		want := test.username
+		if want == "alice-" {
+			want += suffix(test.id)
+		}
+
+		mbox, err := ctl.ExternalUser(test.id)
+		if err != nil {
+			t.Errorf("%s/%s: could not get local user: %v", test.id.Provider, test.id.Subject, err)
+			continue
+		}
+		if mbox.Username != want {
+			t.Errorf("%s/%s: username: %s, want: %s", test.id.Provider, test.id.Subject, mbox.Username, want)
+		}
+
+		key := test.id.Provider + "/" + test.id.Subject
+		if prev, ok := users[mbox.Username]; ok && prev != key {
+			t.Errorf("%s: user %s is already linked to %s", key, mbox.Username, prev)
+		}
+		users[mbox.Username] = key
+	}
+
+	// local user must not be taken over by external identity
+	err := ctl.GetUser(&Mailbox{Username: "alice", Password: "password"})
+	if err != nil {
+		t.Errorf("local user has been changed: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+var passwordCost int = bcrypt.DefaultCost
+
+// this hash is only used to spend the same amount of time checking passwords of users which do not exist,
+// it is computed on first use, since the cost is only known after flags have been parsed
+var dummyLock sync.Mutex
+var dummyHash []byte
+
+// getDummyHash returns dummy hash made with the current cost, it is made again if the cost has been changed
+func getDummyHash() []byte {
+	dummyLock.Lock()
+	defer dummyLock.Unlock()
+
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != passwordCost {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("apparat dummy password"), passwordCost)
+	}
+
+	return dummyHash
+}
+
+func SetPasswordCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("invalid password hash cost %d, must be in [%d, %d] range", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	passwordCost = cost
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", fmt.Errorf("could not hash password: %v", err)
+	}
+
+	return string(hash), nil
+}
+
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword compares stored password (either bcrypt hash or legacy plaintext) with the provided one.
+// It returns true if stored password has to be rehashed, i.e. it is a plaintext or its cost differs from the current one.
+func CheckPassword(stored, password string) (bool, error) {
+	if !IsPasswordHash(stored) {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+			return false, fmt.Errorf("username or password mismatch")
+		}
+
+		return true, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+	if err != nil {
+		return false, fmt.Errorf("username or password mismatch")
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		return true, nil
+	}
+
+	return cost != passwordCost, nil
+}
+
+func fakePasswordCheck(password string) {
+	bcrypt.CompareHashAndPassword(getDummyHash(), []byte(password))
+}
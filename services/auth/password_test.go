@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	setTestPasswordCost(t, bcrypt.MinCost)
+
+	current, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	outdated, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+
+	tests := []struct {
+		name			string
+		stored			string
+		password		string
+		ok			bool
+		rehash			bool
+	}{
+		{"plaintext", "secret", "secret", true, true},
+		{"plaintext mismatch", "secret", "wrong", false, false},
+		{"current cost", string(current), "secret", true, false},
+		{"current cost mismatch", string(current), "wrong", false, false},
+		{"outdated cost", string(outdated), "secret", true, true},
+		{"outdated cost mismatch", string(outdated), "wrong", false, false},
+	}
+
+	for _, test := range tests {
+		rehash, err := CheckPassword(test.stored, test.password)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error: %v, must succeed: %v", test.name, err, test.ok)
+		}
+		if rehash != test.rehash {
+			t.Errorf("%s: rehash: %v, want: %v", test.name, rehash, test.rehash)
+		}
+	}
+}
+
+func TestLoginRehash(t *testing.T) {
+	setTestPasswordCost(t, bcrypt.MinCost)
+
+	outdated, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+
+	tests := []struct {
+		name			string
+		stored			string
+		password		string
+		ok			bool
+		rehashed		bool
+	}{
+		{"plaintext", "secret", "secret", true, true},
+		{"plaintext mismatch", "secret", "wrong", false, false},
+		{"outdated cost", string(outdated), "secret", true, true},
+		{"outdated cost mismatch", string(outdated), "wrong", false, false},
+	}
+
+	for _, test := range tests {
+		ctl := newTestCtl(t)
+		err = ctl.store.CreateUser(&Mailbox {
+			Username:	"alice",
+			Roles:		[]string{RoleUser},
+		}, test.stored)
+		if err != nil {
+			t.Fatalf("%s: could not create user: %v", test.name, err)
+		}
+
+		err = ctl.GetUser(&Mailbox {
+			Username:	"alice",
+			Password:	test.password,
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: login error: %v, must succeed: %v", test.name, err, test.ok)
+		}
+
+		_, hash, err := ctl.store.ReadUser("alice")
+		if err != nil {
+			t.Fatalf("%s: could not read user: %v", test.name, err)
+		}
+
+		if rehashed := hash != test.stored; rehashed != test.rehashed {
+			t.Errorf("%s: password has been rehashed: %v, want: %v", test.name, rehashed, test.rehashed)
+		}
+		if !test.rehashed {
+			continue
+		}
+
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil || cost != bcrypt.MinCost {
+			t.Errorf("%s: stored hash cost: %d, error: %v, want: %d", test.name, cost, err, bcrypt.MinCost)
+		}
+		_, err = CheckPassword(hash, test.password)
+		if err != nil {
+			t.Errorf("%s: rehashed password does not match: %v", test.name, err)
+		}
+	}
+}
+
+func TestDummyHashCost(t *testing.T) {
+	for _, cost := range []int{bcrypt.MinCost, bcrypt.MinCost + 1} {
+		setTestPasswordCost(t, cost)
+
+		hash_cost, err := bcrypt.Cost(getDummyHash())
+		if err != nil {
+			t.Fatalf("invalid dummy hash: %v", err)
+		}
+		if hash_cost != cost {
+			t.Errorf("dummy hash cost: %d, want: %d", hash_cost, cost)
+		}
+	}
+}
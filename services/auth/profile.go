@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"time"
+)
+
+// Profile is what user can learn about its own account and current session
+type Profile struct {
+	Username		string		`json:"username"`
+	Realname		string		`json:"realname"`
+	Email			string		`json:"email"`
+	EmailVerified		bool		`json:"email_verified"`
+	Created			time.Time	`json:"created"`
+	Roles			[]string	`json:"roles"`
+	Scopes			[]string	`json:"scopes"`
+
+	TOTPEnabled		bool		`json:"totp_enabled"`
+	RecoveryCodes		int		`json:"recovery_codes"`
+
+	SessionCreated		time.Time	`json:"session_created"`
+	// session expires at this time unless it is used, idle sessions are extended on every request
+	SessionExpiredAt	time.Time	`json:"session_expired_at"`
+
+	// deletion job if account is being deleted
+	Deletion		*Deletion	`json:"deletion,omitempty"`
+}
+
+// Profile collects user data and state of the session @ac, which must have been checked by CheckSession()
+func (ctl *AuthCtl) Profile(ac *AuthCookie) (*Profile, error) {
+	mbox := &Mailbox {
+		Username:	ac.Username,
+	}
+	err := ctl.LookupUser(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile {
+		Username:	mbox.Username,
+		Realname:	mbox.Realname,
+		Email:		mbox.Email,
+		Created:	mbox.Created,
+		Roles:		ac.Roles,
+		Scopes:		ac.Scopes,
+	}
+
+	p.EmailVerified, err = ctl.EmailVerified(mbox.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := ctl.GetTOTP(mbox.Username)
+	if err != nil {
+		return nil, err
+	}
+	p.TOTPEnabled = st.Enabled
+	if st.Enabled {
+		p.RecoveryCodes = len(st.RecoveryCodes)
+	}
+
+	s, err := ctl.store.ReadSession(ac.Token)
+	if err != nil {
+		return nil, err
+	}
+	p.SessionCreated = s.Created
+	p.SessionExpiredAt = s.ExpiredAt
+	if deadline := s.Created.Add(sessionLifetime); deadline.Before(p.SessionExpiredAt) {
+		p.SessionExpiredAt = deadline
+	}
+	if !ac.ExpiredAt.IsZero() && ac.ExpiredAt.Before(p.SessionExpiredAt) {
+		p.SessionExpiredAt = ac.ExpiredAt
+	}
+
+	p.Deletion, err = ctl.GetDeletion(mbox.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
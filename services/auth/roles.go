@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	RoleUser string = "user"
+	RoleAdmin string = "admin"
+	RoleReadOnly string = "readonly"
+)
+
+var AllRoles = []string{RoleUser, RoleAdmin, RoleReadOnly}
+
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func SplitRoles(roles string) []string {
+	ret := make([]string, 0)
+	for _, r := range strings.Split(roles, ",") {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			ret = append(ret, r)
+		}
+	}
+
+	return ret
+}
+
+func CheckRoles(roles []string) error {
+	if len(roles) == 0 {
+		return fmt.Errorf("user must have at least one role")
+	}
+
+	for _, r := range roles {
+		if !HasRole(AllRoles, r) {
+			return fmt.Errorf("invalid role '%s', allowed roles: %v", r, AllRoles)
+		}
+	}
+
+	return nil
+}
+
+// ScopesForRoles returns scopes which sessions and API tokens of the user with given roles can have,
+// read-only users can not modify anything unless they have another role
+func ScopesForRoles(roles []string) []string {
+	if HasRole(roles, RoleUser) || HasRole(roles, RoleAdmin) {
+		return AllScopes
+	}
+	if HasRole(roles, RoleReadOnly) {
+		return []string{ScopeRead}
+	}
+
+	return []string{}
+}
+
+func (ctl *AuthCtl) ListUsers() ([]Mailbox, error) {
+	return ctl.store.ListUsers()
+}
+
+func (ctl *AuthCtl) SetRoles(username string, roles []string) error {
+	err := CheckRoles(roles)
+	if err != nil {
+		return err
+	}
+
+	mbox := &Mailbox {
+		Username:	username,
+	}
+	err = ctl.LookupUser(mbox)
+	if err != nil {
+		return err
+	}
+
+	return ctl.store.SetRoles(username, roles)
+}
+
+func (ctl *AuthCtl) AddRole(username, role string) error {
+	mbox := &Mailbox {
+		Username:	username,
+	}
+	err := ctl.LookupUser(mbox)
+	if err != nil {
+		return err
+	}
+
+	if HasRole(mbox.Roles, role) {
+		return nil
+	}
+
+	return ctl.SetRoles(username, append(mbox.Roles, role))
+}
+
+// SetDisabled disables or enables account, all sessions and API tokens of disabled account are revoked
+func (ctl *AuthCtl) SetDisabled(username string, disabled bool) error {
+	mbox := &Mailbox {
+		Username:	username,
+	}
+	err := ctl.LookupUser(mbox)
+	if err != nil {
+		return err
+	}
+
+	err = ctl.store.SetDisabled(username, disabled)
+	if err != nil {
+		return err
+	}
+
+	if !disabled {
+		return nil
+	}
+
+	err = ctl.RevokeUserSessions(username, "")
+	if err != nil {
+		return err
+	}
+
+	return ctl.store.RevokeUserTokens(username)
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+func NewSessionID() (string, error) {
+	return randomHex(32)
+}
+
+func (ctl *AuthCtl) NewSession(username string) (*AuthCookie, error) {
+	mbox := &Mailbox {
+		Username:	username,
+	}
+	err := ctl.LookupUser(mbox)
+	if err != nil {
+		return nil, err
+	}
+	if mbox.Disabled {
+		return nil, fmt.Errorf("account %s is disabled", username)
+	}
+
+	id, err := NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	ac := NewAuthCookie(username)
+	ac.Token = id
+	ac.Roles = mbox.Roles
+	ac.Scopes = ScopesForRoles(mbox.Roles)
+
+	now := time.Now()
+	err = ctl.store.CreateSession(&Session {
+		ID:		ac.Token,
+		Username:	ac.Username,
+		Created:	now,
+		ExpiredAt:	sessionExpiration(now, ac.ExpiredAt),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+// sessionExpiration returns time when session used at @now expires if it is not used again,
+// it never exceeds absolute session deadline @max
+func sessionExpiration(now, max time.Time) time.Time {
+	if sessionIdle == 0 {
+		return max
+	}
+
+	exp := now.Add(sessionIdle)
+	if exp.After(max) {
+		return max
+	}
+	return exp
+}
+
+// idle sessions are not extended more often than this to avoid writing into the store on every request
+const sessionTouchInterval time.Duration = time.Minute
+
+func (ctl *AuthCtl) CheckSession(ac *AuthCookie) error {
+	if len(ac.Token) == 0 {
+		return fmt.Errorf("cookie does not contain session id")
+	}
+
+	s, err := ctl.store.ReadSession(ac.Token)
+	if err != nil {
+		return err
+	}
+
+	if s.Username != ac.Username {
+		return fmt.Errorf("session does not belong to user %s", ac.Username)
+	}
+	if s.Revoked {
+		return fmt.Errorf("revoked session")
+	}
+
+	now := time.Now()
+	deadline := s.Created.Add(sessionLifetime)
+	if now.After(s.ExpiredAt) || now.After(deadline) {
+		return fmt.Errorf("expired session")
+	}
+
+	mbox := &Mailbox {
+		Username:	s.Username,
+	}
+	err = ctl.LookupUser(mbox)
+	if err != nil {
+		return err
+	}
+	if mbox.Disabled {
+		return fmt.Errorf("account %s is disabled", mbox.Username)
+	}
+
+	if sessionIdle != 0 {
+		if deadline.After(ac.ExpiredAt) {
+			deadline = ac.ExpiredAt
+		}
+
+		exp := sessionExpiration(now, deadline)
+		if exp.Sub(s.ExpiredAt) >= sessionTouchInterval {
+			err = ctl.store.TouchSession(s.ID, exp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// roles could have been changed since session has been created
+	ac.Roles = mbox.Roles
+	ac.Scopes = ScopesForRoles(ac.Roles)
+
+	d, err := ctl.store.ReadDeletion(mbox.Username)
+	if err != nil {
+		return err
+	}
+	if d != nil && d.HasScope(ac.Token, now) {
+		ac.Scopes = append(ac.Scopes[:len(ac.Scopes):len(ac.Scopes)], ScopeDelete)
+	}
+	return nil
+}
+
+func (ctl *AuthCtl) RevokeSession(id string) error {
+	return ctl.store.RevokeSession(id)
+}
+
+// RevokeUserSessions revokes every session of the given user except @keep, which can be empty
+func (ctl *AuthCtl) RevokeUserSessions(username, keep string) error {
+	return ctl.store.RevokeUserSessions(username, keep)
+}
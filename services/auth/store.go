@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+type Session struct {
+	ID			string
+	Username		string
+	Created			time.Time
+	ExpiredAt		time.Time
+	Revoked			bool
+}
+
+// UserStore hides where users, sessions and tokens live, it only stores and returns data,
+// all checks (passwords, expiration, revocation and so on) are performed by AuthCtl
+type UserStore interface {
+	Ping() error
+	Close()
+
+	// users, Mailbox.Password is never used, password hash is passed separately
+	CreateUser(mbox *Mailbox, hash string) error
+	// returns user data and password hash
+	ReadUser(username string) (*Mailbox, string, error)
+	// password hash is not changed if @hash is empty, email verification is reset if email has been changed
+	UpdateUser(mbox *Mailbox, hash string) error
+	ListUsers() ([]Mailbox, error)
+	SetPasswordHash(username, hash string) error
+	SetRoles(username string, roles []string) error
+	SetDisabled(username string, disabled bool) error
+	EmailVerified(username string) (bool, error)
+	// marks email as verified if it is still equal to @email, returns false otherwise
+	SetEmailVerified(username, email string) (bool, error)
+	ReadTOTP(username string) (*TOTPState, error)
+	WriteTOTP(username string, st *TOTPState) error
+
+	// sessions
+	CreateSession(s *Session) error
+	ReadSession(id string) (*Session, error)
+	// moves session expiration time, used to implement idle timeout
+	TouchSession(id string, expired_at time.Time) error
+	RevokeSession(id string) error
+	// revokes all sessions of the user except @keep
+	RevokeUserSessions(username, keep string) error
+
+	// API tokens, only hash of the token secret is stored
+	CreateToken(t *APIToken, hash string) error
+	ReadToken(id string) (*APIToken, string, error)
+	ListTokens(username string) ([]APIToken, error)
+	RevokeToken(id string) error
+	RevokeUserTokens(username string) error
+
+	// email tokens
+	CreateEmailToken(et *EmailToken) error
+	// marks token as used, returns false if it has already been used or does not exist
+	UseEmailToken(id, username string) (bool, error)
+
+	// external identities
+	IdentityUser(provider, subject string) (string, error)
+	CreateIdentity(provider, subject, username string) error
+
+	// account deletion jobs, ReadDeletion() returns nil if there is no job for the user
+	CreateDeletion(d *Deletion) error
+	ReadDeletion(username string) (*Deletion, error)
+	UpdateDeletion(d *Deletion) error
+	// removes user and everything stored for it: sessions, tokens, identities and deletion job,
+	// audit log is kept
+	DeleteUser(username string) error
+
+	// audit log can only be appended to
+	AppendAudit(e *AuditEvent) error
+	ListAudit(q *AuditQuery) ([]AuditEvent, error)
+}
+
+// NewUserStore creates store of the given type, @dbparams is not used for memory store
+func NewUserStore(dbtype, dbparams string) (UserStore, error) {
+	switch dbtype {
+	case "mysql", "sqlite3":
+		return NewSQLStore(dbtype, dbparams)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported user store '%s', must be one of: mysql, sqlite3, memory", dbtype)
+	}
+}
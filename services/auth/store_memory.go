@@ -0,0 +1,481 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryUser struct {
+	mbox			Mailbox
+	hash			string
+	email_verified		bool
+	totp			TOTPState
+}
+
+type memoryEmailToken struct {
+	et			EmailToken
+	used			bool
+}
+
+// MemoryStore keeps everything in memory, it is lost on restart, which is fine for tests and experiments
+type MemoryStore struct {
+	sync.Mutex
+
+	users			map[string]*memoryUser
+	sessions		map[string]*Session
+	tokens			map[string]*APIToken
+	token_hashes		map[string]string
+	email_tokens		map[string]*memoryEmailToken
+	identities		map[string]string
+	deletions		map[string]*Deletion
+	audit			[]AuditEvent
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore {
+		users:		make(map[string]*memoryUser),
+		sessions:	make(map[string]*Session),
+		tokens:		make(map[string]*APIToken),
+		token_hashes:	make(map[string]string),
+		email_tokens:	make(map[string]*memoryEmailToken),
+		identities:	make(map[string]string),
+		deletions:	make(map[string]*Deletion),
+	}
+}
+
+func (st *MemoryStore) Ping() error {
+	return nil
+}
+
+func (st *MemoryStore) Close() {
+}
+
+func copyMailbox(mbox *Mailbox) Mailbox {
+	cp := *mbox
+	cp.Password = ""
+	cp.Roles = append([]string{}, mbox.Roles...)
+	return cp
+}
+
+func (st *MemoryStore) user(username string) (*memoryUser, error) {
+	u, ok := st.users[username]
+	if !ok {
+		return nil, fmt.Errorf("there is no user %s", username)
+	}
+
+	return u, nil
+}
+
+func (st *MemoryStore) CreateUser(mbox *Mailbox, hash string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if _, ok := st.users[mbox.Username]; ok {
+		return fmt.Errorf("could not insert new user: %s: user already exists", mbox.String())
+	}
+
+	st.users[mbox.Username] = &memoryUser {
+		mbox:		copyMailbox(mbox),
+		hash:		hash,
+	}
+	return nil
+}
+
+func (st *MemoryStore) ReadUser(username string) (*Mailbox, string, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	u, err := st.user(username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mbox := copyMailbox(&u.mbox)
+	return &mbox, u.hash, nil
+}
+
+func (st *MemoryStore) UpdateUser(mbox *Mailbox, hash string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	u, ok := st.users[mbox.Username]
+	if !ok {
+		return nil
+	}
+
+	if u.mbox.Email != mbox.Email {
+		u.email_verified = false
+	}
+	u.mbox.Realname = mbox.Realname
+	u.mbox.Email = mbox.Email
+	if hash != "" {
+		u.hash = hash
+	}
+
+	return nil
+}
+
+func (st *MemoryStore) ListUsers() ([]Mailbox, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	users := make([]Mailbox, 0, len(st.users))
+	for _, u := range st.users {
+		users = append(users, copyMailbox(&u.mbox))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+func (st *MemoryStore) SetPasswordHash(username, hash string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if u, ok := st.users[username]; ok {
+		u.hash = hash
+	}
+	return nil
+}
+
+func (st *MemoryStore) SetRoles(username string, roles []string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if u, ok := st.users[username]; ok {
+		u.mbox.Roles = append([]string{}, roles...)
+	}
+	return nil
+}
+
+func (st *MemoryStore) SetDisabled(username string, disabled bool) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if u, ok := st.users[username]; ok {
+		u.mbox.Disabled = disabled
+	}
+	return nil
+}
+
+func (st *MemoryStore) EmailVerified(username string) (bool, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	u, err := st.user(username)
+	if err != nil {
+		return false, err
+	}
+
+	return u.email_verified, nil
+}
+
+func (st *MemoryStore) SetEmailVerified(username, email string) (bool, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	u, ok := st.users[username]
+	if !ok || u.mbox.Email != email {
+		return false, nil
+	}
+
+	u.email_verified = true
+	return true, nil
+}
+
+func (st *MemoryStore) ReadTOTP(username string) (*TOTPState, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	u, err := st.user(username)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := u.totp
+	ts.RecoveryCodes = append([]string{}, u.totp.RecoveryCodes...)
+	return &ts, nil
+}
+
+func (st *MemoryStore) WriteTOTP(username string, ts *TOTPState) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if u, ok := st.users[username]; ok {
+		u.totp = *ts
+		u.totp.RecoveryCodes = append([]string{}, ts.RecoveryCodes...)
+	}
+	return nil
+}
+
+func (st *MemoryStore) CreateSession(s *Session) error {
+	st.Lock()
+	defer st.Unlock()
+
+	cp := *s
+	st.sessions[s.ID] = &cp
+	return nil
+}
+
+func (st *MemoryStore) ReadSession(id string) (*Session, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("there is no such session")
+	}
+
+	cp := *s
+	return &cp, nil
+}
+
+func (st *MemoryStore) TouchSession(id string, expired_at time.Time) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if s, ok := st.sessions[id]; ok {
+		s.ExpiredAt = expired_at
+	}
+	return nil
+}
+
+func (st *MemoryStore) RevokeSession(id string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if s, ok := st.sessions[id]; ok {
+		s.Revoked = true
+	}
+	return nil
+}
+
+func (st *MemoryStore) RevokeUserSessions(username, keep string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	for id, s := range st.sessions {
+		if s.Username == username && id != keep {
+			s.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (st *MemoryStore) CreateToken(t *APIToken, hash string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	cp := *t
+	cp.Scopes = append([]string{}, t.Scopes...)
+	st.tokens[t.ID] = &cp
+	st.token_hashes[t.ID] = hash
+	return nil
+}
+
+func (st *MemoryStore) ReadToken(id string) (*APIToken, string, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	t, ok := st.tokens[id]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid token")
+	}
+
+	cp := *t
+	cp.Scopes = append([]string{}, t.Scopes...)
+	return &cp, st.token_hashes[id], nil
+}
+
+func (st *MemoryStore) ListTokens(username string) ([]APIToken, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	tokens := make([]APIToken, 0)
+	for _, t := range st.tokens {
+		if t.Username == username {
+			cp := *t
+			cp.Scopes = append([]string{}, t.Scopes...)
+			tokens = append(tokens, cp)
+		}
+	}
+
+	// same order as SQL stores: tokens created within the same second are ordered by id
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens, nil
+}
+
+func (st *MemoryStore) RevokeToken(id string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if t, ok := st.tokens[id]; ok {
+		t.Revoked = true
+	}
+	return nil
+}
+
+func (st *MemoryStore) RevokeUserTokens(username string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	for _, t := range st.tokens {
+		if t.Username == username {
+			t.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (st *MemoryStore) CreateEmailToken(et *EmailToken) error {
+	st.Lock()
+	defer st.Unlock()
+
+	st.email_tokens[et.ID] = &memoryEmailToken {
+		et:		*et,
+	}
+	return nil
+}
+
+func (st *MemoryStore) UseEmailToken(id, username string) (bool, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	t, ok := st.email_tokens[id]
+	if !ok || t.used || t.et.Username != username {
+		return false, nil
+	}
+
+	t.used = true
+	return true, nil
+}
+
+func identityKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (st *MemoryStore) IdentityUser(provider, subject string) (string, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	return st.identities[identityKey(provider, subject)], nil
+}
+
+func (st *MemoryStore) CreateIdentity(provider, subject, username string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	key := identityKey(provider, subject)
+	if _, ok := st.identities[key]; ok {
+		return fmt.Errorf("could not link identity %s/%s to user %s: identity already exists", provider, subject, username)
+	}
+
+	st.identities[key] = username
+	return nil
+}
+
+func (st *MemoryStore) CreateDeletion(d *Deletion) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if _, ok := st.deletions[d.Username]; ok {
+		return fmt.Errorf("could not insert deletion job for user %s: job already exists", d.Username)
+	}
+
+	cp := *d
+	st.deletions[d.Username] = &cp
+	return nil
+}
+
+func (st *MemoryStore) ReadDeletion(username string) (*Deletion, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	d, ok := st.deletions[username]
+	if !ok {
+		return nil, nil
+	}
+
+	cp := *d
+	return &cp, nil
+}
+
+func (st *MemoryStore) UpdateDeletion(d *Deletion) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if _, ok := st.deletions[d.Username]; ok {
+		cp := *d
+		st.deletions[d.Username] = &cp
+	}
+	return nil
+}
+
+func (st *MemoryStore) DeleteUser(username string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	for id, s := range st.sessions {
+		if s.Username == username {
+			delete(st.sessions, id)
+		}
+	}
+	for id, t := range st.tokens {
+		if t.Username == username {
+			delete(st.tokens, id)
+			delete(st.token_hashes, id)
+		}
+	}
+	for id, t := range st.email_tokens {
+		if t.et.Username == username {
+			delete(st.email_tokens, id)
+		}
+	}
+	for key, u := range st.identities {
+		if u == username {
+			delete(st.identities, key)
+		}
+	}
+	delete(st.deletions, username)
+	delete(st.users, username)
+	return nil
+}
+
+func (st *MemoryStore) AppendAudit(e *AuditEvent) error {
+	st.Lock()
+	defer st.Unlock()
+
+	st.audit = append(st.audit, *e)
+	return nil
+}
+
+func (st *MemoryStore) ListAudit(q *AuditQuery) ([]AuditEvent, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	events := make([]AuditEvent, 0)
+	for _, e := range st.audit {
+		if len(events) >= q.Limit {
+			break
+		}
+		if e.Time.Before(q.Since) || e.Time.After(q.Until) {
+			continue
+		}
+		if q.Username != "" && e.Username != q.Username {
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
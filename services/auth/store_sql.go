@@ -0,0 +1,608 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+// mysql schema lives in db/auth/create.sql, sqlite database is created on the fly
+var sqliteSchema = []string {
+	"CREATE TABLE IF NOT EXISTS users (" +
+		"username VARCHAR(128) NOT NULL PRIMARY KEY, " +
+		"password VARCHAR(64) NOT NULL, " +
+		"realname VARCHAR(128) NULL DEFAULT NULL, " +
+		"email VARCHAR(128) NULL DEFAULT NULL, " +
+		"email_verified TINYINT(1) NOT NULL DEFAULT 0, " +
+		"created DATETIME NULL DEFAULT NULL, " +
+		"totp_secret VARCHAR(64) NULL DEFAULT NULL, " +
+		"totp_enabled TINYINT(1) NOT NULL DEFAULT 0, " +
+		"totp_last BIGINT NOT NULL DEFAULT 0, " +
+		"recovery_codes TEXT NULL DEFAULT NULL, " +
+		"roles VARCHAR(255) NOT NULL DEFAULT 'user', " +
+		"disabled TINYINT(1) NOT NULL DEFAULT 0)",
+	"CREATE TABLE IF NOT EXISTS sessions (" +
+		"id VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"username VARCHAR(128) NOT NULL, " +
+		"created DATETIME NOT NULL, " +
+		"expired_at DATETIME NOT NULL, " +
+		"revoked TINYINT(1) NOT NULL DEFAULT 0)",
+	"CREATE INDEX IF NOT EXISTS sessions_username ON sessions (username)",
+	"CREATE TABLE IF NOT EXISTS tokens (" +
+		"id VARCHAR(32) NOT NULL PRIMARY KEY, " +
+		"username VARCHAR(128) NOT NULL, " +
+		"name VARCHAR(128) NOT NULL, " +
+		"hash VARCHAR(64) NOT NULL, " +
+		"scopes VARCHAR(255) NOT NULL, " +
+		"created DATETIME NOT NULL, " +
+		"expired_at DATETIME NOT NULL, " +
+		"revoked TINYINT(1) NOT NULL DEFAULT 0)",
+	"CREATE INDEX IF NOT EXISTS tokens_username ON tokens (username)",
+	"CREATE TABLE IF NOT EXISTS email_tokens (" +
+		"id VARCHAR(32) NOT NULL PRIMARY KEY, " +
+		"username VARCHAR(128) NOT NULL, " +
+		"purpose VARCHAR(16) NOT NULL, " +
+		"created DATETIME NOT NULL, " +
+		"expired_at DATETIME NOT NULL, " +
+		"used TINYINT(1) NOT NULL DEFAULT 0)",
+	"CREATE TABLE IF NOT EXISTS identities (" +
+		"provider VARCHAR(64) NOT NULL, " +
+		"subject VARCHAR(255) NOT NULL, " +
+		"username VARCHAR(128) NOT NULL, " +
+		"created DATETIME NOT NULL, " +
+		"PRIMARY KEY (provider, subject))",
+	"CREATE TABLE IF NOT EXISTS deletions (" +
+		"username VARCHAR(128) NOT NULL PRIMARY KEY, " +
+		"stage VARCHAR(16) NOT NULL, " +
+		"objects BIGINT NOT NULL DEFAULT 0, " +
+		"error TEXT NULL DEFAULT NULL, " +
+		"created DATETIME NOT NULL, " +
+		"updated DATETIME NOT NULL, " +
+		"session VARCHAR(64) NOT NULL DEFAULT '', " +
+		"scope_expired_at DATETIME NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS audit (" +
+		"time DATETIME NOT NULL, " +
+		"event VARCHAR(32) NOT NULL, " +
+		"username VARCHAR(128) NOT NULL, " +
+		"actor VARCHAR(128) NOT NULL DEFAULT '', " +
+		"success TINYINT(1) NOT NULL, " +
+		"request_id VARCHAR(64) NOT NULL DEFAULT '', " +
+		"client_ip VARCHAR(64) NOT NULL DEFAULT '', " +
+		"details TEXT NULL DEFAULT NULL)",
+	"CREATE INDEX IF NOT EXISTS audit_username_time ON audit (username, time)",
+	"CREATE INDEX IF NOT EXISTS audit_time ON audit (time)",
+}
+
+// SQLStore only uses SQL which both mysql and sqlite understand
+type SQLStore struct {
+	db		*sql.DB
+}
+
+func NewSQLStore(dbtype, dbparams string) (*SQLStore, error) {
+	db, err := sql.Open(dbtype, dbparams)
+	if err != nil {
+		return nil, fmt.Errorf("could not open db: %s, params: %s: %v", dbtype, dbparams, err)
+	}
+
+	if dbtype == "sqlite3" {
+		// sqlite does not support concurrent writers
+		db.SetMaxOpenConns(1)
+
+		for _, q := range sqliteSchema {
+			_, err = db.Exec(q)
+			if err != nil {
+				db.Close()
+				return nil, fmt.Errorf("could not create sqlite schema: %s, params: %s: %v", q, dbparams, err)
+			}
+		}
+	}
+
+	st := &SQLStore {
+		db:		db,
+	}
+
+	return st, nil
+}
+
+func (st *SQLStore) Ping() error {
+	return st.db.Ping()
+}
+
+func (st *SQLStore) Close() {
+	st.db.Close()
+}
+
+func (st *SQLStore) CreateUser(mbox *Mailbox, hash string) error {
+	_, err := st.db.Exec("INSERT INTO users (username,password,realname,email,created,roles,disabled) VALUES (?,?,?,?,?,?,?)",
+		mbox.Username, hash, mbox.Realname, mbox.Email, mbox.Created, strings.Join(mbox.Roles, ","), false)
+	if err != nil {
+		return fmt.Errorf("could not insert new user: %s: %v", mbox.String(), err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ReadUser(username string) (*Mailbox, string, error) {
+	rows, err := st.db.Query("SELECT username,password,realname,email,created,roles,disabled FROM users WHERE username=?",
+		username)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read userinfo for user: %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var password, roles string
+		mbox := &Mailbox{}
+
+		err = rows.Scan(&mbox.Username, &password, &mbox.Realname, &mbox.Email, &mbox.Created, &roles, &mbox.Disabled)
+		if err != nil {
+			return nil, "", fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		if mbox.Username != username {
+			return nil, "", fmt.Errorf("there is no user %s", username)
+		}
+
+		mbox.Roles = SplitRoles(roles)
+		return mbox, password, nil
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return nil, "", fmt.Errorf("there is no user %s", username)
+}
+
+func (st *SQLStore) UpdateUser(mbox *Mailbox, hash string) error {
+	// mysql evaluates assignments from left to right, so email_verified must be updated before email
+	query := "UPDATE users SET email_verified=CASE WHEN email=? THEN email_verified ELSE 0 END,realname=?,email=?"
+	args := []interface{} {mbox.Email, mbox.Realname, mbox.Email}
+
+	if hash != "" {
+		query += ",password=?"
+		args = append(args, hash)
+	}
+
+	query += " WHERE username=?"
+	args = append(args, mbox.Username)
+
+	_, err := st.db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("could not update user: %s: %v", mbox.String(), err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ListUsers() ([]Mailbox, error) {
+	rows, err := st.db.Query("SELECT username,realname,email,created,roles,disabled FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("could not read users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]Mailbox, 0)
+	for rows.Next() {
+		var mbox Mailbox
+		var roles string
+
+		err = rows.Scan(&mbox.Username, &mbox.Realname, &mbox.Email, &mbox.Created, &roles, &mbox.Disabled)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		mbox.Roles = SplitRoles(roles)
+		users = append(users, mbox)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return users, nil
+}
+
+func (st *SQLStore) SetPasswordHash(username, hash string) error {
+	_, err := st.db.Exec("UPDATE users SET password=? WHERE username=?", hash, username)
+	if err != nil {
+		return fmt.Errorf("could not update password for user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) SetRoles(username string, roles []string) error {
+	_, err := st.db.Exec("UPDATE users SET roles=? WHERE username=?", strings.Join(roles, ","), username)
+	if err != nil {
+		return fmt.Errorf("could not set roles of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) SetDisabled(username string, disabled bool) error {
+	_, err := st.db.Exec("UPDATE users SET disabled=? WHERE username=?", disabled, username)
+	if err != nil {
+		return fmt.Errorf("could not update account state of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) EmailVerified(username string) (bool, error) {
+	var verified bool
+
+	err := st.db.QueryRow("SELECT email_verified FROM users WHERE username=?", username).Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("there is no user %s", username)
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read email state of user %s: %v", username, err)
+	}
+
+	return verified, nil
+}
+
+func (st *SQLStore) SetEmailVerified(username, email string) (bool, error) {
+	_, err := st.db.Exec("UPDATE users SET email_verified=1 WHERE username=? AND email=?", username, email)
+	if err != nil {
+		return false, fmt.Errorf("could not verify email of user %s: %v", username, err)
+	}
+
+	// mysql reports 0 affected rows if email has already been verified, so check the state explicitly
+	var verified bool
+	err = st.db.QueryRow("SELECT email_verified FROM users WHERE username=? AND email=?", username, email).Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read email state of user %s: %v", username, err)
+	}
+
+	return verified, nil
+}
+
+func (st *SQLStore) ReadTOTP(username string) (*TOTPState, error) {
+	rows, err := st.db.Query("SELECT totp_secret,totp_enabled,totp_last,recovery_codes FROM users WHERE username=?", username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read TOTP state for user: %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var secret, codes sql.NullString
+		ts := &TOTPState{}
+
+		err = rows.Scan(&secret, &ts.Enabled, &ts.Last, &codes)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		ts.Secret = secret.String
+		if codes.String != "" {
+			ts.RecoveryCodes = strings.Split(codes.String, "\n")
+		}
+
+		return ts, nil
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return nil, fmt.Errorf("there is no user %s", username)
+}
+
+func (st *SQLStore) WriteTOTP(username string, ts *TOTPState) error {
+	secret := sql.NullString {
+		String:		ts.Secret,
+		Valid:		ts.Secret != "",
+	}
+	codes := sql.NullString {
+		String:		strings.Join(ts.RecoveryCodes, "\n"),
+		Valid:		len(ts.RecoveryCodes) != 0,
+	}
+
+	_, err := st.db.Exec("UPDATE users SET totp_secret=?,totp_enabled=?,totp_last=?,recovery_codes=? WHERE username=?",
+		secret, ts.Enabled, ts.Last, codes, username)
+	if err != nil {
+		return fmt.Errorf("could not update TOTP state for user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) CreateSession(s *Session) error {
+	_, err := st.db.Exec("INSERT INTO sessions (id,username,created,expired_at,revoked) VALUES (?,?,?,?,?)",
+		s.ID, s.Username, s.Created, s.ExpiredAt, s.Revoked)
+	if err != nil {
+		return fmt.Errorf("could not insert new session for user %s: %v", s.Username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ReadSession(id string) (*Session, error) {
+	s := &Session {
+		ID:		id,
+	}
+
+	err := st.db.QueryRow("SELECT username,created,expired_at,revoked FROM sessions WHERE id=?", id).Scan(
+		&s.Username, &s.Created, &s.ExpiredAt, &s.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no such session")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read session: %v", err)
+	}
+
+	return s, nil
+}
+
+func (st *SQLStore) TouchSession(id string, expired_at time.Time) error {
+	_, err := st.db.Exec("UPDATE sessions SET expired_at=? WHERE id=?", expired_at, id)
+	if err != nil {
+		return fmt.Errorf("could not update session: %v", err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) RevokeSession(id string) error {
+	_, err := st.db.Exec("UPDATE sessions SET revoked=1 WHERE id=?", id)
+	if err != nil {
+		return fmt.Errorf("could not revoke session: %v", err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) RevokeUserSessions(username, keep string) error {
+	_, err := st.db.Exec("UPDATE sessions SET revoked=1 WHERE username=? AND id<>?", username, keep)
+	if err != nil {
+		return fmt.Errorf("could not revoke sessions of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) CreateToken(t *APIToken, hash string) error {
+	_, err := st.db.Exec("INSERT INTO tokens (id,username,name,hash,scopes,created,expired_at,revoked) VALUES (?,?,?,?,?,?,?,?)",
+		t.ID, t.Username, t.Name, hash, strings.Join(t.Scopes, ","), t.Created, t.ExpiredAt, t.Revoked)
+	if err != nil {
+		return fmt.Errorf("could not insert new token for user %s: %v", t.Username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ReadToken(id string) (*APIToken, string, error) {
+	var hash, scopes string
+	t := &APIToken {
+		ID:		id,
+	}
+
+	err := st.db.QueryRow("SELECT username,name,hash,scopes,created,expired_at,revoked FROM tokens WHERE id=?", id).Scan(
+		&t.Username, &t.Name, &hash, &scopes, &t.Created, &t.ExpiredAt, &t.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, "", fmt.Errorf("invalid token")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read token %s: %v", id, err)
+	}
+
+	t.Scopes = strings.Split(scopes, ",")
+	return t, hash, nil
+}
+
+func (st *SQLStore) ListTokens(username string) ([]APIToken, error) {
+	rows, err := st.db.Query("SELECT id,username,name,scopes,created,expired_at,revoked FROM tokens WHERE username=? ORDER BY created, id", username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tokens of user %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+
+		err = rows.Scan(&t.ID, &t.Username, &t.Name, &scopes, &t.Created, &t.ExpiredAt, &t.Revoked)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		t.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return tokens, nil
+}
+
+func (st *SQLStore) RevokeToken(id string) error {
+	_, err := st.db.Exec("UPDATE tokens SET revoked=1 WHERE id=?", id)
+	if err != nil {
+		return fmt.Errorf("could not revoke token %s: %v", id, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) RevokeUserTokens(username string) error {
+	_, err := st.db.Exec("UPDATE tokens SET revoked=1 WHERE username=?", username)
+	if err != nil {
+		return fmt.Errorf("could not revoke tokens of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) CreateEmailToken(et *EmailToken) error {
+	_, err := st.db.Exec("INSERT INTO email_tokens (id,username,purpose,created,expired_at,used) VALUES (?,?,?,?,?,?)",
+		et.ID, et.Username, et.Purpose, et.Created, et.ExpiredAt, false)
+	if err != nil {
+		return fmt.Errorf("could not insert email token for user %s: %v", et.Username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) UseEmailToken(id, username string) (bool, error) {
+	res, err := st.db.Exec("UPDATE email_tokens SET used=1 WHERE id=? AND username=? AND used=0", id, username)
+	if err != nil {
+		return false, fmt.Errorf("could not update email token: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not update email token: %v", err)
+	}
+
+	return n == 1, nil
+}
+
+func (st *SQLStore) IdentityUser(provider, subject string) (string, error) {
+	var username string
+
+	err := st.db.QueryRow("SELECT username FROM identities WHERE provider=? AND subject=?", provider, subject).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read identity %s/%s: %v", provider, subject, err)
+	}
+
+	return username, nil
+}
+
+func (st *SQLStore) CreateIdentity(provider, subject, username string) error {
+	_, err := st.db.Exec("INSERT INTO identities (provider,subject,username,created) VALUES (?,?,?,?)",
+		provider, subject, username, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not link identity %s/%s to user %s: %v", provider, subject, username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) CreateDeletion(d *Deletion) error {
+	_, err := st.db.Exec("INSERT INTO deletions (username,stage,objects,error,created,updated,session,scope_expired_at) " +
+		"VALUES (?,?,?,?,?,?,?,?)",
+		d.Username, d.Stage, d.Objects, d.Error, d.Created, d.Updated, d.Session, d.ScopeExpiredAt)
+	if err != nil {
+		return fmt.Errorf("could not insert deletion job for user %s: %v", d.Username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ReadDeletion(username string) (*Deletion, error) {
+	var errstr sql.NullString
+	d := &Deletion {
+		Username:	username,
+	}
+
+	err := st.db.QueryRow("SELECT stage,objects,error,created,updated,session,scope_expired_at FROM deletions WHERE username=?",
+		username).Scan(&d.Stage, &d.Objects, &errstr, &d.Created, &d.Updated, &d.Session, &d.ScopeExpiredAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read deletion job of user %s: %v", username, err)
+	}
+
+	d.Error = errstr.String
+	return d, nil
+}
+
+func (st *SQLStore) UpdateDeletion(d *Deletion) error {
+	_, err := st.db.Exec("UPDATE deletions SET stage=?,objects=?,error=?,updated=?,session=?,scope_expired_at=? WHERE username=?",
+		d.Stage, d.Objects, d.Error, d.Updated, d.Session, d.ScopeExpiredAt, d.Username)
+	if err != nil {
+		return fmt.Errorf("could not update deletion job of user %s: %v", d.Username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) DeleteUser(username string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not delete user %s: %v", username, err)
+	}
+
+	for _, table := range []string{"sessions", "tokens", "email_tokens", "identities", "deletions", "users"} {
+		_, err = tx.Exec("DELETE FROM " + table + " WHERE username=?", username)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not delete user %s from %s: %v", username, table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not delete user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) AppendAudit(e *AuditEvent) error {
+	_, err := st.db.Exec("INSERT INTO audit (time,event,username,actor,success,request_id,client_ip,details) VALUES (?,?,?,?,?,?,?,?)",
+		e.Time, e.Event, e.Username, e.Actor, e.Success, e.RequestID, e.ClientIP, e.Details)
+	if err != nil {
+		return fmt.Errorf("could not insert audit event: %v", err)
+	}
+
+	return nil
+}
+
+func (st *SQLStore) ListAudit(q *AuditQuery) ([]AuditEvent, error) {
+	query := "SELECT time,event,username,actor,success,request_id,client_ip,details FROM audit WHERE time>=? AND time<=?"
+	args := []interface{}{q.Since, q.Until}
+	if q.Username != "" {
+		query += " AND username=?"
+		args = append(args, q.Username)
+	}
+	query += " ORDER BY time LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit log: %v", err)
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0)
+	for rows.Next() {
+		var e AuditEvent
+		var details sql.NullString
+
+		err = rows.Scan(&e.Time, &e.Event, &e.Username, &e.Actor, &e.Success, &e.RequestID, &e.ClientIP, &details)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		e.Details = details.String
+		events = append(events, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestPasswordCost makes hashing fast, the previous cost is restored when test ends
+func setTestPasswordCost(t *testing.T, cost int) {
+	prev := passwordCost
+	err := SetPasswordCost(cost)
+	if err != nil {
+		t.Fatalf("could not set password cost: %v", err)
+	}
+	t.Cleanup(func() {
+		passwordCost = prev
+	})
+}
+
+func newTestCtl(t *testing.T) *AuthCtl {
+	setTestPasswordCost(t, bcrypt.MinCost)
+
+	return &AuthCtl {
+		store:		NewMemoryStore(),
+	}
+}
+
+func newTestUser(t *testing.T, ctl *AuthCtl, username, password string) {
+	err := ctl.NewUser(&Mailbox {
+		Username:	username,
+		Password:	password,
+		Email:		username + "@example.com",
+	})
+	if err != nil {
+		t.Fatalf("could not create user %s: %v", username, err)
+	}
+}
+
+// storeScenario runs the same sequence of operations against the store and records what has been observed,
+// SQL stores only keep seconds, so all times are whole seconds in UTC
+func storeScenario(st UserStore) []string {
+	log := make([]string, 0)
+	record := func(format string, args ...interface{}) {
+		log = append(log, fmt.Sprintf(format, args...))
+	}
+	at := func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	}
+	failed := func(err error) bool {
+		return err != nil
+	}
+
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, name := range []string{"bob", "alice"} {
+		err := st.CreateUser(&Mailbox {
+			Username:	name,
+			Realname:	strings.ToUpper(name),
+			Email:		name + "@example.com",
+			Created:	now,
+			Roles:		[]string{RoleUser},
+		}, "hash-" + name)
+		record("create user %s: failed: %v", name, failed(err))
+	}
+	err := st.CreateUser(&Mailbox{Username: "alice", Roles: []string{RoleUser}}, "hash")
+	record("create duplicate user: failed: %v", failed(err))
+
+	err = st.UpdateUser(&Mailbox{Username: "alice", Realname: "Alice", Email: "alice@example.com"}, "")
+	record("update user: failed: %v", failed(err))
+	ok, err := st.SetEmailVerified("alice", "alice@example.com")
+	record("verify email: %v, failed: %v", ok, failed(err))
+	ok, err = st.SetEmailVerified("alice", "other@example.com")
+	record("verify changed email: %v, failed: %v", ok, failed(err))
+	verified, err := st.EmailVerified("alice")
+	record("email verified: %v, failed: %v", verified, failed(err))
+	err = st.UpdateUser(&Mailbox{Username: "alice", Realname: "Alice", Email: "new@example.com"}, "new-hash")
+	record("change email: failed: %v", failed(err))
+	verified, err = st.EmailVerified("alice")
+	record("email verified after change: %v, failed: %v", verified, failed(err))
+
+	err = st.SetRoles("bob", []string{RoleUser, RoleAdmin})
+	record("set roles: failed: %v", failed(err))
+	err = st.SetDisabled("bob", true)
+	record("disable: failed: %v", failed(err))
+	err = st.SetPasswordHash("bob", "rehashed")
+	record("set password hash: failed: %v", failed(err))
+
+	for _, name := range []string{"alice", "bob", "nobody"} {
+		mbox, hash, err := st.ReadUser(name)
+		if err != nil {
+			record("read user %s: failed", name)
+			continue
+		}
+		record("read user %s: realname: %s, email: %s, roles: %v, disabled: %v, hash: %s",
+			name, mbox.Realname, mbox.Email, mbox.Roles, mbox.Disabled, hash)
+	}
+
+	users, err := st.ListUsers()
+	for _, u := range users {
+		record("list user: %s, roles: %v, disabled: %v", u.Username, u.Roles, u.Disabled)
+	}
+	record("list users: failed: %v", failed(err))
+
+	err = st.WriteTOTP("alice", &TOTPState {
+		Secret:		rfcSecret,
+		Enabled:	true,
+		Last:		37037037,
+		RecoveryCodes:	[]string{"h1", "h2"},
+	})
+	record("write totp: failed: %v", failed(err))
+	for _, name := range []string{"alice", "bob"} {
+		ts, err := st.ReadTOTP(name)
+		if err != nil {
+			record("read totp %s: failed", name)
+			continue
+		}
+		record("read totp %s: secret: %s, enabled: %v, last: %d, recovery codes: %v",
+			name, ts.Secret, ts.Enabled, ts.Last, ts.RecoveryCodes)
+	}
+
+	for _, id := range []string{"s1", "s2", "s3"} {
+		err = st.CreateSession(&Session {
+			ID:		id,
+			Username:	"alice",
+			Created:	now,
+			ExpiredAt:	now.Add(time.Hour),
+		})
+		record("create session %s: failed: %v", id, failed(err))
+	}
+	err = st.TouchSession("s1", now.Add(2 * time.Hour))
+	record("touch session: failed: %v", failed(err))
+	err = st.RevokeSession("s2")
+	record("revoke session: failed: %v", failed(err))
+	err = st.RevokeUserSessions("alice", "s1")
+	record("revoke user sessions: failed: %v", failed(err))
+	for _, id := range []string{"s1", "s2", "s3", "missing"} {
+		s, err := st.ReadSession(id)
+		if err != nil {
+			record("read session %s: failed", id)
+			continue
+		}
+		record("read session %s: user: %s, created: %s, expired at: %s, revoked: %v",
+			id, s.Username, at(s.Created), at(s.ExpiredAt), s.Revoked)
+	}
+
+	for _, id := range []string{"t2", "t1"} {
+		err = st.CreateToken(&APIToken {
+			ID:		id,
+			Username:	"alice",
+			Name:		"token " + id,
+			Scopes:		[]string{ScopeRead, ScopeWrite},
+			Created:	now,
+			ExpiredAt:	now.Add(time.Hour),
+		}, "hash-" + id)
+		record("create token %s: failed: %v", id, failed(err))
+	}
+	err = st.RevokeToken("t2")
+	record("revoke token: failed: %v", failed(err))
+	tokens, err := st.ListTokens("alice")
+	for _, tk := range tokens {
+		record("list token %s: name: %s, scopes: %v, created: %s, expired at: %s, revoked: %v",
+			tk.ID, tk.Name, tk.Scopes, at(tk.Created), at(tk.ExpiredAt), tk.Revoked)
+	}
+	record("list tokens: failed: %v", failed(err))
+	tk, hash, err := st.ReadToken("t1")
+	if err == nil {
+		record("read token: user: %s, hash: %s, revoked: %v", tk.Username, hash, tk.Revoked)
+	}
+	_, _, err = st.ReadToken("missing")
+	record("read missing token: failed: %v", failed(err))
+	err = st.RevokeUserTokens("alice")
+	record("revoke user tokens: failed: %v", failed(err))
+	tk, _, err = st.ReadToken("t1")
+	record("read token after revoking all: revoked: %v, failed: %v", err == nil && tk.Revoked, failed(err))
+
+	err = st.CreateEmailToken(&EmailToken {
+		ID:		"e1",
+		Username:	"alice",
+		Purpose:	PurposeReset,
+		Created:	now,
+		ExpiredAt:	now.Add(time.Hour),
+	})
+	record("create email token: failed: %v", failed(err))
+	for _, user := range []string{"bob", "alice", "alice"} {
+		ok, err := st.UseEmailToken("e1", user)
+		record("use email token by %s: %v, failed: %v", user, ok, failed(err))
+	}
+
+	err = st.CreateIdentity("oidc", "subject", "alice")
+	record("create identity: failed: %v", failed(err))
+	for _, subject := range []string{"subject", "other"} {
+		name, err := st.IdentityUser("oidc", subject)
+		record("identity %s: user: '%s', failed: %v", subject, name, failed(err))
+	}
+
+	d, err := st.ReadDeletion("alice")
+	record("read missing deletion: nil: %v, failed: %v", d == nil, failed(err))
+	err = st.CreateDeletion(&Deletion {
+		Username:	"alice",
+		Stage:		DeletionObjects,
+		Created:	now,
+		Updated:	now,
+		Session:	"s1",
+		ScopeExpiredAt:	now.Add(DeletionScopeTimeout),
+	})
+	record("create deletion: failed: %v", failed(err))
+	err = st.UpdateDeletion(&Deletion {
+		Username:	"alice",
+		Stage:		DeletionIndex,
+		Objects:	42,
+		Error:		"failed",
+		Created:	now,
+		Updated:	now.Add(time.Minute),
+		Session:	"s1",
+		ScopeExpiredAt:	now.Add(DeletionScopeTimeout + time.Minute),
+	})
+	record("update deletion: failed: %v", failed(err))
+	d, err = st.ReadDeletion("alice")
+	if err == nil && d != nil {
+		record("read deletion: stage: %s, objects: %d, error: %s, created: %s, updated: %s, session: %s, scope expired at: %s",
+			d.Stage, d.Objects, d.Error, at(d.Created), at(d.Updated), d.Session, at(d.ScopeExpiredAt))
+	}
+
+	for i, name := range []string{"alice", "bob", "alice"} {
+		err = st.AppendAudit(&AuditEvent {
+			Time:		now.Add(time.Duration(i) * time.Minute),
+			Event:		AuditLogin,
+			Username:	name,
+			Success:	i != 1,
+			RequestID:	fmt.Sprintf("r%d", i),
+			ClientIP:	"127.0.0.1",
+			Details:	"details",
+		})
+		record("append audit: failed: %v", failed(err))
+	}
+	// stores get queries with defaults already filled in by AuthCtl.ListAudit()
+	end := now.Add(time.Hour)
+	for _, q := range []AuditQuery {
+		{Until: end, Limit: 10},
+		{Username: "alice", Until: end, Limit: 10},
+		{Since: now.Add(time.Minute), Until: end, Limit: 10},
+		{Until: now.Add(time.Minute), Limit: 10},
+		{Until: end, Limit: 1},
+	} {
+		events, err := st.ListAudit(&q)
+		for _, e := range events {
+			record("audit %+v: time: %s, event: %s, user: %s, success: %v, request: %s, client: %s, details: %s",
+				q, at(e.Time), e.Event, e.Username, e.Success, e.RequestID, e.ClientIP, e.Details)
+		}
+		record("list audit %+v: failed: %v", q, failed(err))
+	}
+
+	err = st.DeleteUser("alice")
+	record("delete user: failed: %v", failed(err))
+	_, _, err = st.ReadUser("alice")
+	record("read deleted user: failed: %v", failed(err))
+	_, err = st.ReadSession("s1")
+	record("read session of deleted user: failed: %v", failed(err))
+	tokens, err = st.ListTokens("alice")
+	record("tokens of deleted user: %d, failed: %v", len(tokens), failed(err))
+	name, err := st.IdentityUser("oidc", "subject")
+	record("identity of deleted user: '%s', failed: %v", name, failed(err))
+	d, err = st.ReadDeletion("alice")
+	record("deletion of deleted user: nil: %v, failed: %v", d == nil, failed(err))
+	events, err := st.ListAudit(&AuditQuery{Username: "alice", Until: end, Limit: 10})
+	record("audit of deleted user: %d, failed: %v", len(events), failed(err))
+
+	return log
+}
+
+func TestStoreParity(t *testing.T) {
+	sqlite, err := NewUserStore("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("could not open sqlite store: %v", err)
+	}
+	defer sqlite.Close()
+
+	memory, err := NewUserStore("memory", "")
+	if err != nil {
+		t.Fatalf("could not open memory store: %v", err)
+	}
+	defer memory.Close()
+
+	want := storeScenario(memory)
+	got := storeScenario(sqlite)
+
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+
+		if w != g {
+			t.Errorf("step %d:\n\tmemory: %s\n\tsqlite: %s", i, w, g)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API tokens look like 'apparat_<id>_<secret>', only sha256 of the secret is stored in the database
+const TokenPrefix string = "apparat_"
+
+const (
+	ScopeRead string = "read"
+	ScopeWrite string = "write"
+)
+
+var AllScopes = []string{ScopeRead, ScopeWrite}
+
+type APIToken struct {
+	ID			string		`json:"id"`
+	Username		string		`json:"username"`
+	Name			string		`json:"name"`
+	Scopes			[]string	`json:"scopes"`
+	Created			time.Time	`json:"created"`
+	ExpiredAt		time.Time	`json:"expired_at"`
+	Revoked			bool		`json:"revoked"`
+}
+
+func BearerToken(r *http.Request) string {
+	hdr := r.Header.Get("Authorization")
+	if len(hdr) < len("Bearer ") || !strings.EqualFold(hdr[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(hdr[len("Bearer "):])
+}
+
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate random data: %v", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseToken(token string) (string, string, error) {
+	if !strings.HasPrefix(token, TokenPrefix) {
+		return "", "", fmt.Errorf("invalid token format")
+	}
+
+	parts := strings.SplitN(token[len(TokenPrefix):], "_", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid token format")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// NewToken creates new API token and returns its description and the token string itself,
+// the latter is never stored and can not be retrieved later.
+func (ctl *AuthCtl) NewToken(username, name string, scopes []string, ttl time.Duration) (*APIToken, string, error) {
+	if len(name) == 0 {
+		return nil, "", fmt.Errorf("token name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("token must have at least one scope")
+	}
+	mbox := &Mailbox {
+		Username:	username,
+	}
+	err := ctl.LookupUser(mbox)
+	if err != nil {
+		return nil, "", err
+	}
+
+	allowed := ScopesForRoles(mbox.Roles)
+	for _, s := range scopes {
+		if !HasScope(allowed, s) {
+			return nil, "", fmt.Errorf("invalid scope '%s', allowed scopes: %v", s, allowed)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &APIToken {
+		ID:		id,
+		Username:	username,
+		Name:		name,
+		Scopes:		scopes,
+		Created:	time.Now(),
+	}
+	t.ExpiredAt = t.Created.Add(ttl)
+
+	err = ctl.store.CreateToken(t, hashSecret(secret))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return t, TokenPrefix + id + "_" + secret, nil
+}
+
+func (ctl *AuthCtl) ListTokens(username string) ([]APIToken, error) {
+	return ctl.store.ListTokens(username)
+}
+
+func (ctl *AuthCtl) RevokeToken(username, id string) error {
+	t, _, err := ctl.store.ReadToken(id)
+	if err != nil || t.Username != username {
+		return fmt.Errorf("user %s does not have token %s", username, id)
+	}
+
+	return ctl.store.RevokeToken(id)
+}
+
+// CheckToken validates API token string and returns auth info which looks exactly like the one stored in cookie,
+// @Token field contains token id.
+func (ctl *AuthCtl) CheckToken(token string) (*AuthCookie, error) {
+	id, secret, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	t, hash, err := ctl.store.ReadToken(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) != 1 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if t.Revoked {
+		return nil, fmt.Errorf("revoked token")
+	}
+	if time.Now().After(t.ExpiredAt) {
+		return nil, fmt.Errorf("expired token")
+	}
+
+	mbox := &Mailbox {
+		Username:	t.Username,
+	}
+	err = ctl.LookupUser(mbox)
+	if err != nil {
+		return nil, err
+	}
+	if mbox.Disabled {
+		return nil, fmt.Errorf("account %s is disabled", mbox.Username)
+	}
+
+	// token scopes can not exceed what user's current roles allow,
+	// roles themselves are not copied, tokens must not pass RequireRole() checks like admin endpoints
+	ac := &AuthCookie {
+		Username:	t.Username,
+		Token:		t.ID,
+		ExpiredAt:	t.ExpiredAt,
+	}
+	allowed := ScopesForRoles(mbox.Roles)
+	for _, s := range t.Scopes {
+		if HasScope(allowed, s) {
+			ac.Scopes = append(ac.Scopes, s)
+		}
+	}
+	return ac, nil
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, these are the defaults every authenticator application supports
+const (
+	totpPeriod int64 = 30
+	totpDigits int = 6
+	totpSkew int64 = 1
+)
+
+const recoveryCodesNumber int = 10
+
+const PendingLoginCookieName string = "apparat_2fa"
+
+// password has been checked, but the second factor has to be provided within this interval
+const pendingLoginTimeout time.Duration = 5 * time.Minute
+
+type PendingLogin struct {
+	Username		string
+	ExpiredAt		time.Time
+}
+
+func init() {
+	gob.Register(&PendingLogin{})
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate random TOTP secret: %v", err)
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum) - 1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value % mod)
+}
+
+// CheckTOTP returns time counter which matched the code, it must be greater than @last to prevent code reuse
+func CheckTOTP(secret, code string, last int64, t time.Time) (int64, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+
+	code = strings.TrimSpace(code)
+	counter := t.Unix() / totpPeriod
+	for c := counter - totpSkew; c <= counter + totpSkew; c++ {
+		if c <= last {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return c, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid TOTP code")
+}
+
+func TOTPURL(issuer, username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(username), v.Encode())
+}
+
+type TOTPState struct {
+	Secret			string
+	Enabled			bool
+	Last			int64
+	RecoveryCodes		[]string
+}
+
+func (ctl *AuthCtl) GetTOTP(username string) (*TOTPState, error) {
+	return ctl.store.ReadTOTP(username)
+}
+
+// EnrollTOTP generates new secret for the user, it is not used for login until confirmed by ConfirmTOTP()
+func (ctl *AuthCtl) EnrollTOTP(username string) (string, error) {
+	st, err := ctl.GetTOTP(username)
+	if err != nil {
+		return "", err
+	}
+	if st.Enabled {
+		return "", fmt.Errorf("two-factor authentication is already enabled for user %s", username)
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = ctl.store.WriteTOTP(username, &TOTPState {
+		Secret:		secret,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func newRecoveryCode() (string, error) {
+	code, err := randomHex(5)
+	if err != nil {
+		return "", err
+	}
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// ConfirmTOTP enables two-factor authentication if @code matches enrolled secret,
+// recovery codes are returned in plaintext, only their hashes are stored
+func (ctl *AuthCtl) ConfirmTOTP(username, code string) ([]string, error) {
+	st, err := ctl.GetTOTP(username)
+	if err != nil {
+		return nil, err
+	}
+	if st.Enabled {
+		return nil, fmt.Errorf("two-factor authentication is already enabled for user %s", username)
+	}
+	if st.Secret == "" {
+		return nil, fmt.Errorf("user %s has not started two-factor authentication enrollment", username)
+	}
+
+	counter, err := CheckTOTP(st.Secret, code, st.Last, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodesNumber)
+	hashes := make([]string, 0, recoveryCodesNumber)
+	for i := 0; i < recoveryCodesNumber; i++ {
+		rc, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := HashPassword(rc)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, rc)
+		hashes = append(hashes, hash)
+	}
+
+	st.Enabled = true
+	st.Last = counter
+	st.RecoveryCodes = hashes
+	err = ctl.store.WriteTOTP(username, st)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (ctl *AuthCtl) DisableTOTP(username string) error {
+	return ctl.store.WriteTOTP(username, &TOTPState{})
+}
+
+// CheckSecondFactor accepts either current TOTP code or one of unused recovery codes, the latter is removed after use
+func (ctl *AuthCtl) CheckSecondFactor(username, code string) error {
+	st, err := ctl.GetTOTP(username)
+	if err != nil {
+		return err
+	}
+	if !st.Enabled {
+		return fmt.Errorf("two-factor authentication is not enabled for user %s", username)
+	}
+
+	counter, err := CheckTOTP(st.Secret, code, st.Last, time.Now())
+	if err == nil {
+		st.Last = counter
+		return ctl.store.WriteTOTP(username, st)
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range st.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+
+		st.RecoveryCodes = append(st.RecoveryCodes[:i:i], st.RecoveryCodes[i+1:]...)
+		return ctl.store.WriteTOTP(username, st)
+	}
+
+	return fmt.Errorf("invalid two-factor authentication code")
+}
+
+func SetPendingLogin(r *http.Request, w http.ResponseWriter, username string) error {
+	session, err := getCookieStore().Get(r, PendingLoginCookieName)
+	if err != nil && session == nil {
+		return fmt.Errorf("could not read cookie: %v", err)
+	}
+
+	session.Options = cookieOptions(int(pendingLoginTimeout.Seconds()))
+	session.Values["pending"] = &PendingLogin {
+		Username:	username,
+		ExpiredAt:	time.Now().Add(pendingLoginTimeout),
+	}
+	return session.Save(r, w)
+}
+
+func CheckPendingLogin(r *http.Request) (string, error) {
+	session, err := getCookieStore().Get(r, PendingLoginCookieName)
+	if err != nil {
+		return "", fmt.Errorf("could not read cookie: %v", err)
+	}
+
+	pl, ok := session.Values["pending"].(*PendingLogin)
+	if !ok || len(pl.Username) == 0 {
+		return "", fmt.Errorf("there is no login waiting for the second factor")
+	}
+
+	if time.Now().After(pl.ExpiredAt) {
+		return "", fmt.Errorf("login has expired")
+	}
+
+	return pl.Username, nil
+}
+
+func ClearPendingLogin(r *http.Request, w http.ResponseWriter) error {
+	session, err := getCookieStore().Get(r, PendingLoginCookieName)
+	if err != nil && session == nil {
+		return fmt.Errorf("could not read cookie: %v", err)
+	}
+
+	session.Options = cookieOptions(-1)
+	delete(session.Values, "pending")
+	return session.Save(r, w)
+}
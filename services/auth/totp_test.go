@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B uses ASCII "12345678901234567890" as SHA1 key and 8 digits,
+// 6-digit codes are the last 6 digits of the reference values
+const rfcSecret string = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCheckTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix			int64
+		code			string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		counter, err := CheckTOTP(rfcSecret, test.code, 0, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Errorf("time: %d, code: %s: %v", test.unix, test.code, err)
+			continue
+		}
+		if want := test.unix / totpPeriod; counter != want {
+			t.Errorf("time: %d, code: %s: counter: %d, want: %d", test.unix, test.code, counter, want)
+		}
+	}
+}
+
+func TestCheckTOTPWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	counter := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name			string
+		code			string
+		last			int64
+		ok			bool
+	}{
+		{"current", "050471", 0, true},
+		{"lowercase secret and spaces", " 050471 ", 0, true},
+		{"previous period", "081804", 0, true},
+		{"next period", totpCode([]byte("12345678901234567890"), counter + 1), 0, true},
+		{"too old", totpCode([]byte("12345678901234567890"), counter - 2), 0, false},
+		{"too new", totpCode([]byte("12345678901234567890"), counter + 2), 0, false},
+		{"reused", "050471", counter, false},
+		{"older than used", "081804", counter, false},
+		{"wrong", "000000", 0, false},
+	}
+
+	for _, test := range tests {
+		secret := rfcSecret
+		if strings.HasPrefix(test.name, "lowercase") {
+			secret = strings.ToLower(secret)
+		}
+
+		_, err := CheckTOTP(secret, test.code, test.last, now)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: code: %s, last: %d: error: %v, must succeed: %v", test.name, test.code, test.last, err, test.ok)
+		}
+	}
+
+	_, err := CheckTOTP("not base32!", "050471", 0, now)
+	if err == nil {
+		t.Errorf("invalid secret has been accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	ctl := newTestCtl(t)
+	newTestUser(t, ctl, "alice", "password")
+
+	secret, err := ctl.EnrollTOTP("alice")
+	if err != nil {
+		t.Fatalf("could not enroll: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %s: %v", secret, err)
+	}
+
+	codes, err := ctl.ConfirmTOTP("alice", totpCode(key, time.Now().Unix() / totpPeriod))
+	if err != nil {
+		t.Fatalf("could not confirm enrollment: %v", err)
+	}
+	if len(codes) != recoveryCodesNumber {
+		t.Fatalf("got %d recovery codes, want: %d", len(codes), recoveryCodesNumber)
+	}
+
+	tests := []struct {
+		code			string
+		ok			bool
+		left			int
+	}{
+		{codes[0], true, recoveryCodesNumber - 1},
+		{codes[0], false, recoveryCodesNumber - 1},
+		{" " + strings.ToUpper(codes[5]) + " ", true, recoveryCodesNumber - 2},
+		{"00000-00000", false, recoveryCodesNumber - 2},
+		{codes[recoveryCodesNumber - 1], true, recoveryCodesNumber - 3},
+	}
+
+	for i, test := range tests {
+		err = ctl.CheckSecondFactor("alice", test.code)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: code: %s: error: %v, must succeed: %v", i, test.code, err, test.ok)
+		}
+
+		st, err := ctl.GetTOTP("alice")
+		if err != nil {
+			t.Fatalf("could not read TOTP state: %v", err)
+		}
+		if len(st.RecoveryCodes) != test.left {
+			t.Errorf("%d: code: %s: %d recovery codes left, want: %d", i, test.code, len(st.RecoveryCodes), test.left)
+		}
+	}
+}
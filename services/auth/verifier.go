@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Verifier checks credentials (API token or cookie) of the incoming request
+type Verifier interface {
+	Verify(r *http.Request) (*AuthCookie, error)
+	// VerifyFresh always asks auth server, it is used where cached scopes are not good enough,
+	// like ScopeDelete which is granted right before data is purged
+	VerifyFresh(r *http.Request) (*AuthCookie, error)
+}
+
+// RemoteVerifier asks auth server about every request
+type RemoteVerifier struct {
+	Url			string
+}
+
+func NewRemoteVerifier(auth_url string) *RemoteVerifier {
+	return &RemoteVerifier {
+		Url:		auth_url,
+	}
+}
+
+func (rv *RemoteVerifier) verifyToken(token string) (*AuthCookie, error) {
+	return CheckTokenWeb(rv.Url, token)
+}
+
+func (rv *RemoteVerifier) verifyCookie(cookie *http.Cookie) (*AuthCookie, error) {
+	return CheckCookieWeb(rv.Url, cookie)
+}
+
+func (rv *RemoteVerifier) Verify(r *http.Request) (*AuthCookie, error) {
+	if token := BearerToken(r); token != "" {
+		return rv.verifyToken(token)
+	}
+
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get cookie '%s' from request, error: %v", CookieName, err)
+	}
+
+	return rv.verifyCookie(cookie)
+}
+
+func (rv *RemoteVerifier) VerifyFresh(r *http.Request) (*AuthCookie, error) {
+	return rv.Verify(r)
+}
+
+type verification struct {
+	ac			*AuthCookie
+	err			error
+	checked			time.Time
+}
+
+// LocalVerifier checks cookie signature and expiration locally using the same keys as auth server,
+// auth server is only asked whether session (or API token) has been revoked, its answer is cached for @ttl.
+// If auth server can not be reached, previous positive answer is trusted for @grace period.
+type LocalVerifier struct {
+	remote			*RemoteVerifier
+	ttl			time.Duration
+	grace			time.Duration
+
+	sync.Mutex
+	cache			map[string]*verification
+}
+
+// cache is cleaned up when it grows over this limit
+const verificationCacheSize int = 100000
+
+func NewLocalVerifier(auth_url string, cookie_keys [][]byte, ttl, grace time.Duration) *LocalVerifier {
+	// cookies are only checked here, they are never issued or re-signed, since only auth server knows cookie attributes
+	InitCookieStore(cookie_keys, "/")
+
+	return &LocalVerifier {
+		remote:		NewRemoteVerifier(auth_url),
+		ttl:		ttl,
+		grace:		grace,
+		cache:		make(map[string]*verification),
+	}
+}
+
+// cached returns cached check result if it is not older than ttl, @fresh forces new check,
+// its result replaces cached one
+func (lv *LocalVerifier) cached(key string, fresh bool, check func() (*AuthCookie, error)) (*AuthCookie, error) {
+	now := time.Now()
+
+	lv.Lock()
+	v, ok := lv.cache[key]
+	lv.Unlock()
+
+	if ok && !fresh && now.Sub(v.checked) < lv.ttl {
+		return v.ac, v.err
+	}
+
+	ac, err := check()
+	if err != nil {
+		if _, rejected := err.(*RejectError); !rejected {
+			// auth server is not available, fall back to the last positive answer if it is not too old,
+			// fresh check must not rely on any earlier answer
+			if ok && !fresh && v.err == nil && now.Sub(v.checked) < lv.grace {
+				return v.ac, nil
+			}
+
+			return nil, err
+		}
+	}
+
+	lv.Lock()
+	if len(lv.cache) >= verificationCacheSize {
+		for k, old := range lv.cache {
+			if now.Sub(old.checked) >= lv.grace {
+				delete(lv.cache, k)
+			}
+		}
+	}
+	lv.cache[key] = &verification {
+		ac:		ac,
+		err:		err,
+		checked:	now,
+	}
+	lv.Unlock()
+
+	return ac, err
+}
+
+func (lv *LocalVerifier) Verify(r *http.Request) (*AuthCookie, error) {
+	return lv.verify(r, false)
+}
+
+func (lv *LocalVerifier) VerifyFresh(r *http.Request) (*AuthCookie, error) {
+	return lv.verify(r, true)
+}
+
+func (lv *LocalVerifier) verify(r *http.Request, fresh bool) (*AuthCookie, error) {
+	if token := BearerToken(r); token != "" {
+		return lv.cached("token\x00" + hashSecret(token), fresh, func() (*AuthCookie, error) {
+			return lv.remote.verifyToken(token)
+		})
+	}
+
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get cookie '%s' from request, error: %v", CookieName, err)
+	}
+
+	ac, err := CheckAuthCookie(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(ac.Token) == 0 {
+		return nil, fmt.Errorf("cookie does not contain session id")
+	}
+
+	remote_ac, err := lv.cached("session\x00" + ac.Token, fresh, func() (*AuthCookie, error) {
+		return lv.remote.verifyCookie(cookie)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// roles could have been changed after cookie has been issued, auth server knows the current ones
+	ac.Roles = remote_ac.Roles
+	ac.Scopes = remote_ac.Scopes
+	return ac, nil
+}
+
+// NewVerifier creates verifier of the given type: 'remote' checks every request over http,
+// 'local' requires cookie keys shared with auth server and only checks revocation over http
+func NewVerifier(mode, auth_url string, cookie_keys [][]byte, ttl, grace time.Duration) (Verifier, error) {
+	switch mode {
+	case "remote":
+		return NewRemoteVerifier(auth_url), nil
+	case "local":
+		if len(cookie_keys) == 0 {
+			return nil, fmt.Errorf("local verification requires cookie auth key or keyring")
+		}
+
+		return NewLocalVerifier(auth_url, cookie_keys, ttl, grace), nil
+	default:
+		return nil, fmt.Errorf("unsupported verification mode '%s', must be either 'remote' or 'local'", mode)
+	}
+}
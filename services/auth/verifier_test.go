@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerifierCache(t *testing.T) {
+	lv := &LocalVerifier {
+		ttl:		time.Hour,
+		grace:		24 * time.Hour,
+		cache:		make(map[string]*verification),
+	}
+
+	calls := 0
+	accept := func() (*AuthCookie, error) {
+		calls++
+		return &AuthCookie{Username: "alice"}, nil
+	}
+	unavailable := func() (*AuthCookie, error) {
+		calls++
+		return nil, fmt.Errorf("connection refused")
+	}
+	reject := func() (*AuthCookie, error) {
+		calls++
+		return nil, &RejectError{Status: 403, Reason: "session has been revoked"}
+	}
+
+	tests := []struct {
+		name			string
+		fresh			bool
+		expire			bool
+		check			func() (*AuthCookie, error)
+		ok			bool
+		calls			int
+	}{
+		{"first check", false, false, accept, true, 1},
+		{"cached", false, false, unavailable, true, 1},
+		{"fresh check of unavailable server", true, false, unavailable, false, 2},
+		{"grace period", false, true, unavailable, true, 3},
+		{"fresh check", true, false, accept, true, 4},
+		{"revoked", true, false, reject, false, 5},
+		{"cached rejection", false, false, accept, false, 5},
+		{"no grace after rejection", false, true, unavailable, false, 6},
+	}
+
+	for _, test := range tests {
+		if test.expire {
+			lv.cache["key"].checked = time.Now().Add(-2 * lv.ttl)
+		}
+
+		ac, err := lv.cached("key", test.fresh, test.check)
+		if (err == nil) != test.ok || (err == nil && ac.Username != "alice") {
+			t.Errorf("%s: credentials: %+v, error: %v, must succeed: %v", test.name, ac, err, test.ok)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: auth server has been asked %d times, want: %d", test.name, calls, test.calls)
+		}
+	}
+}
@@ -1,13 +1,57 @@
 package index
 
 import (
+	"encoding/json"
 	"github.com/bioothod/apparat/services/common"
+	"github.com/bioothod/apparat/services/nullx"
 	"github.com/golang/glog"
-	"github.com/go-sql-driver/mysql"
 	"database/sql"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// tags are part of URLs and queries, so only these characters are allowed
+var tagRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]{1,32}$")
+
+// number of rows written by a single statement, every row takes at most 7 placeholders
+const IndexBatchSize int = 500
+
+// tag which used to hold list of user's tags, it is not allowed as a regular tag
+const MetaTag string = "meta"
+
+func CheckTag(tag string) error {
+	if !tagRegexp.MatchString(tag) {
+		return fmt.Errorf("invalid tag '%s': must be 1 to 32 letters, digits, '_', '.' or '-'", tag)
+	}
+
+	return nil
+}
+
+func CheckTags(tags []string) error {
+	for _, tag := range tags {
+		err := CheckTag(tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckTags validates every tag of the request before anything is written
+func (ireq *IndexRequest) CheckTags() error {
+	for _, req := range ireq.Files {
+		err := CheckTags(req.Tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 type IndexCtl struct {
 	db		*sql.DB
 }
@@ -48,11 +92,38 @@ type IndexFiles struct {
 
 type ListRequest struct {
 	Tags		[]string		`json:"tags"`
+	// boolean expression over tags like 'video AND (2016-05-01 OR 2016-05-02) AND NOT archived',
+	// it can not be used together with @Tags, reply contains single list of matching files
+	Query		string			`json:"query"`
+
+	// number of files returned per tag, all files are returned if neither limit nor cursor is set,
+	// DefaultListLimit is used if only cursor is set
+	Limit		int			`json:"limit"`
+	// 'next' from the previous reply, it is only allowed when listing single tag, query or time range
+	Cursor		string			`json:"cursor"`
+	// name, timestamp or size, name if not set
+	Sort		string			`json:"sort"`
+	// asc or desc, asc if not set
+	Order		string			`json:"order"`
+
+	// only files with timestamp in [@From, @To) are listed, either bound can be omitted,
+	// if neither tags nor query are set, all user's files in the range are listed
+	From		time.Time		`json:"from"`
+	To		time.Time		`json:"to"`
+	// day, month or year: reply contains number and size of the listed files per period (UTC),
+	// counts are only returned with the first page, i.e. when cursor is not set
+	Calendar	string			`json:"calendar"`
 }
 
 type LReply struct {
 	Tag		string			`json:"tag"`
+	// set instead of tag if files have been selected by boolean query
+	Query		string			`json:"query,omitempty"`
 	Keys		[]common.Reply		`json:"keys"`
+	// cursor for the next page, empty if this is the last one
+	Next		string			`json:"next,omitempty"`
+	// counts of all files matching the request (not only this page) if calendar has been requested, only set in the first page
+	Calendar	[]CalendarEntry		`json:"calendar,omitempty"`
 }
 
 type ListReply struct {
@@ -60,30 +131,24 @@ type ListReply struct {
 }
 
 
+// Indexer works with index of a single user, all users share 'files', 'tags' and 'file_tags' tables:
+// every file is stored once in 'files', tags are linked to files via 'file_tags'
 type Indexer struct {
 	username		string
 	ctl			*IndexCtl
-	meta_index		string
 	modifier		common.ModifierFunc
 }
 
-func (idx *Indexer) index_name(tag string) string {
-	return idx.username + ":" + tag;
-}
-
 func NewIndexer(username string, ctl *IndexCtl) (*Indexer, error) {
+	if username == "" {
+		return nil, fmt.Errorf("empty username")
+	}
+
 	idx := &Indexer {
 		username:		username,
 		ctl:			ctl,
 		modifier:		common.UsernameModifier(username),
 	}
-	idx.meta_index = idx.index_name("meta")
-
-	err := idx.check_and_create_meta()
-	if err != nil {
-		glog.Errorf("could not create meta table '%s': %v", idx.meta_index, err)
-		return nil, err
-	}
 
 	return idx, nil
 }
@@ -103,90 +168,125 @@ func ReformatIndexRequest(idx *IndexRequest) *IndexFiles {
 	return ifiles
 }
 
-func (idx *Indexer) check_and_create_meta() error {
-	_, err := idx.ctl.db.Exec("CREATE TABLE IF NOT EXISTS `" + idx.meta_index +
-		"` (tag VARCHAR(32) NOT NULL PRIMARY KEY) ENGINE=InnoDB DEFAULT CHARSET=UTF8")
-	if err != nil {
-		return fmt.Errorf("could not create table '%s': %v", idx.meta_index, err)
+func placeholders(row string, n int) string {
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = row
 	}
 
-	return nil
+	return strings.Join(rows, ",")
 }
 
-func (idx *Indexer) check_and_create_table(tag string) error {
-	iname := idx.index_name(tag)
+// tag_id returns id of the user's tag creating it if needed
+func (idx *Indexer) tag_id(tx *sql.Tx, tag string) (int64, error) {
+	// LAST_INSERT_ID(id) makes existing row id available via LastInsertId()
+	res, err := tx.Exec("INSERT INTO `tags` (`username`, `tag`) VALUES (?, ?) " +
+		"ON DUPLICATE KEY UPDATE `id`=LAST_INSERT_ID(`id`)", idx.username, tag)
+	if err != nil {
+		return 0, fmt.Errorf("could not create tag '%s': %v", tag, err)
+	}
 
-	if iname == idx.meta_index {
-		return fmt.Errorf("index '%s' is not allowed", tag)
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("could not read id of tag '%s': %v", tag, err)
 	}
 
-	rows, err := idx.ctl.db.Query("SELECT `name` FROM `" + iname + "` LIMIT 1")
+	return id, nil
+}
+
+// index_files does not check tag, it is used by migration to move tags created before validation was introduced
+func (idx *Indexer) index_files(tag string, files []common.Reply) error {
+	tx, err := idx.ctl.db.Begin()
 	if err != nil {
-		e, ok := err.(*mysql.MySQLError)
+		return fmt.Errorf("could not start transaction for tag '%s': %v", tag, err)
+	}
+	defer tx.Rollback()
+
+	tag_id, err := idx.tag_id(tx, tag)
+	if err != nil {
+		return err
+	}
 
-		// If table doesn't exist, do not print this error
-		if !ok || e.Number != 1146 {
-			glog.Errorf("error selecting key from '%s': %v", iname, err)
+	for start := 0; start < len(files); start += IndexBatchSize {
+		end := start + IndexBatchSize
+		if end > len(files) {
+			end = len(files)
 		}
 
-		_, err = idx.ctl.db.Exec("CREATE TABLE `" + iname + "` (" +
-			"`bucket` VARCHAR(32) NOT NULL, " +
-			"`name` VARCHAR(255) NOT NULL, " +
-			"`timestamp` DATETIME NOT NULL, " +
-			"`size` BIGINT UNSIGNED NOT NULL, " +
-			"PRIMARY KEY (`name`)" +
-			") ENGINE=InnoDB DEFAULT CHARSET=UTF8")
-		if err != nil {
-			e, ok := err.(*mysql.MySQLError)
-			if !ok {
-				return fmt.Errorf("could not create table '%s': %v", iname, err)
+		batch := files[start:end]
+		args := make([]interface{}, 0, len(batch) * 7)
+		for _, f := range batch {
+			media, err := pack_media(&f.Media)
+			if err != nil {
+				return fmt.Errorf("could not pack media of file '%s': %v", f.Name, err)
 			}
 
-			// Error 'table already exists' is not error in our case, all others have to be reported
-			if e.Number != 1050 {
-				return fmt.Errorf("could not create table '%s': %v", iname, err)
-			}
+			args = append(args, idx.username, f.Bucket, f.Name, f.Timestamp.UTC(), f.Size, f.ContentType, media)
+		}
+
+		// tagging existing file keeps its bucket, timestamp and size, they are only replaced by newer upload of the same name,
+		// content type and media are only known at upload, tagging existing file must not clear them.
+		// MySQL applies assignments left to right, so `timestamp` has to be updated last
+		_, err = tx.Exec("INSERT INTO `files` (`username`, `bucket`, `name`, `timestamp`, `size`, `content_type`, `media`) VALUES " +
+			placeholders("(?,?,?,?,?,?,?)", len(batch)) +
+			" ON DUPLICATE KEY UPDATE " +
+			"`bucket`=IF(VALUES(`timestamp`) > `timestamp`, VALUES(`bucket`), `bucket`), " +
+			"`size`=IF(VALUES(`timestamp`) > `timestamp`, VALUES(`size`), `size`), " +
+			"`content_type`=IF(VALUES(`content_type`)='', `content_type`, VALUES(`content_type`)), " +
+			"`media`=COALESCE(VALUES(`media`), `media`), " +
+			"`timestamp`=GREATEST(`timestamp`, VALUES(`timestamp`))",
+			args...)
+		if err != nil {
+			return fmt.Errorf("could not insert %d files for tag '%s': %v", len(batch), tag, err)
+		}
+
+		args = make([]interface{}, 0, len(batch) + 2)
+		args = append(args, tag_id, idx.username)
+		for _, f := range batch {
+			args = append(args, f.Name)
 		}
 
-		_, err = idx.ctl.db.Exec("INSERT INTO `" + idx.meta_index + "` SET tag=?", tag)
+		_, err = tx.Exec("INSERT IGNORE INTO `file_tags` (`tag_id`, `file_id`) " +
+			"SELECT ?, `id` FROM `files` WHERE `username`=? AND `name` IN (" + placeholders("?", len(batch)) + ")",
+			args...)
 		if err != nil {
-			return fmt.Errorf("could not insert tag '%s' into '%s' table: %v", tag, idx.meta_index, err)
+			return fmt.Errorf("could not tag %d files with '%s': %v", len(batch), tag, err)
 		}
-	} else {
-		rows.Close()
 	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit %d files into tag '%s': %v", len(files), tag, err)
+	}
+
 	return nil
 }
 
 func (idx *Indexer) IndexFiles(tag string, files []common.Reply) error {
-	err := idx.check_and_create_table(tag)
+	err := CheckTag(tag)
 	if err != nil {
-		glog.Errorf("could not check and create table '%s': %v", tag, err)
 		return err
 	}
-
-	iname := idx.index_name(tag)
-
-	var values string
-	for idx, f := range files {
-		fin := ','
-		if idx == len(files) - 1 {
-			fin = ';'
-		}
-		values += fmt.Sprintf("('%s', '%s', '%s', '%d')%c", f.Bucket, f.Name,
-				f.Timestamp.UTC().Format("2006-01-02 15:04:05.999999"), f.Size, fin)
+	if tag == MetaTag {
+		return fmt.Errorf("index '%s' is not allowed", tag)
 	}
-	glog.Infof("tag: %s, values: %s", iname, values)
-	_, err = idx.ctl.db.Exec("REPLACE INTO `" + iname + "` (`bucket`, `name`, `timestamp`, `size`) VALUES " + values)
+
+	err = idx.index_files(tag, files)
 	if err != nil {
-		glog.Errorf("could not insert into tag '%s' values '%s': %v", iname, values, err)
-		return fmt.Errorf("could not insert into tag '%s' values '%s': %v", iname, values, err)
+		glog.Errorf("could not index files: user: %s, %v", idx.username, err)
+		return err
 	}
 
+	glog.Infof("user: %s, tag: %s, indexed files: %d", idx.username, tag, len(files))
 	return nil
 }
 
 func (idx *Indexer) Index(ireq *IndexRequest) error {
+	err := ireq.CheckTags()
+	if err != nil {
+		return err
+	}
+
 	ifiles := ReformatIndexRequest(ireq)
 
 	for tag, files := range ifiles.Tags {
@@ -200,13 +300,30 @@ func (idx *Indexer) Index(ireq *IndexRequest) error {
 	return nil
 }
 
-func (idx *Indexer) ListIndex(tag string) ([]common.Reply, error) {
-	iname := idx.index_name(tag)
+// pack_media returns media as JSON or nil if there are no tracks
+func pack_media(m *nullx.Media) (interface{}, error) {
+	if len(m.Tracks) == 0 {
+		return nil, nil
+	}
 
-	rows, err := idx.ctl.db.Query("SELECT `bucket`,`name`,`timestamp`,`size` FROM `" + iname + "`")
+	data, err := json.Marshal(m)
 	if err != nil {
-		return nil, fmt.Errorf("could not read names from tag '%s': %v", iname, err)
+		return nil, err
 	}
+
+	return string(data), nil
+}
+
+func unpack_media(media sql.NullString, m *nullx.Media) error {
+	if !media.Valid || media.String == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(media.String), m)
+}
+
+// scan_files reads rows selected as bucket, name, timestamp, size, content_type, media
+func (idx *Indexer) scan_files(rows *sql.Rows) ([]common.Reply, error) {
 	defer rows.Close()
 
 	meta_modifier := common.MetaModifier()
@@ -214,18 +331,24 @@ func (idx *Indexer) ListIndex(tag string) ([]common.Reply, error) {
 	names := make([]common.Reply, 0)
 	for rows.Next() {
 		var n common.Reply
+		var media sql.NullString
 
-		err = rows.Scan(&n.Bucket, &n.Name, &n.Timestamp, &n.Size)
+		err := rows.Scan(&n.Bucket, &n.Name, &n.Timestamp, &n.Size, &n.ContentType, &media)
 		if err != nil {
 			return nil, fmt.Errorf("database schema mismatch: %v", err)
 		}
 
+		err = unpack_media(media, &n.Media)
+		if err != nil {
+			return nil, fmt.Errorf("invalid media of file '%s': %v", n.Name, err)
+		}
+
 		n.MetaKey = idx.modifier(meta_modifier(n.Name))
 		n.Key = idx.modifier(n.Name)
 		names = append(names, n)
 	}
 
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
 		return nil, fmt.Errorf("could not scan database: %v", err)
 	}
@@ -233,10 +356,52 @@ func (idx *Indexer) ListIndex(tag string) ([]common.Reply, error) {
 	return names, nil
 }
 
+// ListIndex returns single page of files with given tag ordered as requested in @lr, which must have been checked
+func (idx *Indexer) ListIndex(tag string, lr *ListRequest) (*LReply, error) {
+	err := CheckTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := idx.list_page(tag_condition, []interface{}{idx.username, tag}, tag, lr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read names from tag '%s': %v", tag, err)
+	}
+
+	reply.Tag = tag
+	return reply, nil
+}
+
+// ListRange returns single page of all user's files within time range of @lr
+func (idx *Indexer) ListRange(lr *ListRequest) (*LReply, error) {
+	reply, err := idx.list_page("TRUE", nil, "range", lr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read names from time range: %v", err)
+	}
+
+	return reply, nil
+}
+
+// ListQuery returns single page of files matching boolean tag query, see ParseQuery() for syntax
+func (idx *Indexer) ListQuery(query string, lr *ListRequest) (*LReply, error) {
+	cond, args, err := idx.compile_query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := idx.list_page(cond, args, "query:" + query, lr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read names matching query '%s': %v", query, err)
+	}
+
+	reply.Query = query
+	return reply, nil
+}
+
 func (idx *Indexer) ListMeta() (*ListReply, error) {
-	rows, err := idx.ctl.db.Query("SELECT `tag` FROM `" + idx.meta_index + "`")
+	rows, err := idx.ctl.db.Query("SELECT `tag` FROM `tags` WHERE `username`=? ORDER BY `tag`", idx.username)
 	if err != nil {
-		return nil, fmt.Errorf("could not read tags from meta index '%s': %v", idx.meta_index, err)
+		return nil, fmt.Errorf("could not read tags of user '%s': %v", idx.username, err)
 	}
 	defer rows.Close()
 
@@ -260,7 +425,7 @@ func (idx *Indexer) ListMeta() (*ListReply, error) {
 	reply := &ListReply {
 		Tags: []LReply {
 			LReply {
-				Tag:		"meta",
+				Tag:		MetaTag,
 				Keys:		names,
 			},
 		},
@@ -268,24 +433,155 @@ func (idx *Indexer) ListMeta() (*ListReply, error) {
 	return reply, nil
 }
 
+type Usage struct {
+	Username	string			`json:"username"`
+	Files		uint64			`json:"files"`
+	Size		uint64			`json:"size"`
+}
+
+// Usage returns number and total size of the files user has
+func (idx *Indexer) Usage() (*Usage, error) {
+	usage := &Usage {
+		Username:	idx.username,
+	}
+
+	err := idx.ctl.db.QueryRow("SELECT COUNT(*),COALESCE(SUM(`size`),0) FROM `files` WHERE `username`=?", idx.username).
+		Scan(&usage.Files, &usage.Size)
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage of user '%s': %v", idx.username, err)
+	}
+
+	return usage, nil
+}
+
 func (idx *Indexer) List(lr *ListRequest) (*ListReply, error) {
+	err := lr.Check()
+	if err != nil {
+		return nil, err
+	}
+
 	reply := &ListReply {
 		Tags:		make([]LReply, 0),
 	}
 
+	if lr.Query != "" {
+		page, err := idx.ListQuery(lr.Query, lr)
+		if err != nil {
+			glog.Errorf("could not list index: query: %s, error: %v", lr.Query, err)
+			return nil, err
+		}
+
+		reply.Tags = append(reply.Tags, *page)
+		return reply, nil
+	}
+
+	if len(lr.Tags) == 0 && lr.has_range() {
+		page, err := idx.ListRange(lr)
+		if err != nil {
+			glog.Errorf("could not list index: from: %s, to: %s, error: %v", lr.From, lr.To, err)
+			return nil, err
+		}
+
+		reply.Tags = append(reply.Tags, *page)
+		return reply, nil
+	}
+
 	for _, tag := range lr.Tags {
-		keys, err := idx.ListIndex(tag)
+		page, err := idx.ListIndex(tag, lr)
 		if err != nil {
 			glog.Errorf("could not list index: tag: %s, error: %v", tag, err)
 			return nil, err
 		}
 
-		lr := LReply {
-			Tag:		tag,
-			Keys:		keys,
-		}
-		reply.Tags = append(reply.Tags, lr)
+		reply.Tags = append(reply.Tags, *page)
 	}
 
 	return reply, nil
 }
+
+func (idx *Indexer) Tags() ([]string, error) {
+	reply, err := idx.ListMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0)
+	for _, n := range reply.Tags[0].Keys {
+		tags = append(tags, n.Name)
+	}
+
+	return tags, nil
+}
+
+// Files returns every file indexed for the user, it is used to remove user's objects from storage,
+// files of the legacy tables which have not been migrated yet are included
+func (idx *Indexer) Files() ([]common.Reply, error) {
+	rows, err := idx.ctl.db.Query("SELECT `bucket`,`name`,`timestamp`,`size`,`content_type`,`media` FROM `files` WHERE `username`=? ORDER BY `name`",
+		idx.username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read files of user '%s': %v", idx.username, err)
+	}
+
+	files, err := idx.scan_files(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := idx.ctl.legacy_user_files(idx.username)
+	if err != nil {
+		return nil, err
+	}
+
+	meta_modifier := common.MetaModifier()
+
+	seen := make(map[string]bool)
+	for _, f := range files {
+		seen[f.Name] = true
+	}
+	for _, f := range legacy {
+		if !seen[f.Name] {
+			f.MetaKey = idx.modifier(meta_modifier(f.Name))
+			f.Key = idx.modifier(f.Name)
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+// Drop removes whole index of the user, it can be called again if it fails halfway
+func (idx *Indexer) Drop() error {
+	tx, err := idx.ctl.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE ft FROM `file_tags` ft JOIN `tags` t ON t.`id`=ft.`tag_id` WHERE t.`username`=?", idx.username)
+	if err != nil {
+		return fmt.Errorf("could not remove tagged files of user '%s': %v", idx.username, err)
+	}
+
+	_, err = tx.Exec("DELETE FROM `tags` WHERE `username`=?", idx.username)
+	if err != nil {
+		return fmt.Errorf("could not remove tags of user '%s': %v", idx.username, err)
+	}
+
+	_, err = tx.Exec("DELETE FROM `files` WHERE `username`=?", idx.username)
+	if err != nil {
+		return fmt.Errorf("could not remove files of user '%s': %v", idx.username, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit removal of user '%s' index: %v", idx.username, err)
+	}
+
+	// user may not have been migrated yet, DDL can not be part of the transaction above
+	err = idx.ctl.legacy_drop(idx.username)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package index
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	SortName string = "name"
+	SortTimestamp string = "timestamp"
+	SortSize string = "size"
+
+	OrderAsc string = "asc"
+	OrderDesc string = "desc"
+)
+
+const (
+	DefaultListLimit int = 100
+	MaxListLimit int = 1000
+)
+
+const (
+	CalendarDay string = "day"
+	CalendarMonth string = "month"
+	CalendarYear string = "year"
+)
+
+// MySQL DATE_FORMAT() formats of calendar periods
+var calendarFormats = map[string]string {
+	CalendarDay:	"%Y-%m-%d",
+	CalendarMonth:	"%Y-%m",
+	CalendarYear:	"%Y",
+}
+
+type CalendarEntry struct {
+	// 2016-05-01, 2016-05 or 2016 depending on the calendar type
+	Period		string			`json:"period"`
+	Files		uint64			`json:"files"`
+	Size		uint64			`json:"size"`
+}
+
+func (lr *ListRequest) has_range() bool {
+	return !lr.From.IsZero() || !lr.To.IsZero()
+}
+
+// range_condition returns condition on files table aliased as 'f', it is empty if there is no time range
+func (lr *ListRequest) range_condition() (string, []interface{}) {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+
+	if !lr.From.IsZero() {
+		conds = append(conds, "f.`timestamp` >= ?")
+		args = append(args, lr.From.UTC())
+	}
+	if !lr.To.IsZero() {
+		conds = append(conds, "f.`timestamp` < ?")
+		args = append(args, lr.To.UTC())
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+// Check validates list request and fills in defaults
+func (lr *ListRequest) Check() error {
+	err := CheckTags(lr.Tags)
+	if err != nil {
+		return err
+	}
+
+	if lr.Query != "" {
+		if len(lr.Tags) != 0 {
+			return fmt.Errorf("either tags or query can be listed, not both")
+		}
+
+		_, err = ParseQuery(lr.Query)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !lr.From.IsZero() && !lr.To.IsZero() && !lr.To.After(lr.From) {
+		return fmt.Errorf("invalid time range: to %s must be after from %s", lr.To, lr.From)
+	}
+	if lr.Calendar != "" {
+		_, ok := calendarFormats[lr.Calendar]
+		if !ok {
+			return fmt.Errorf("invalid calendar '%s', must be one of %s, %s or %s", lr.Calendar, CalendarDay, CalendarMonth, CalendarYear)
+		}
+	}
+
+	single := len(lr.Tags) == 1 || lr.Query != "" || (len(lr.Tags) == 0 && lr.has_range())
+	if lr.Cursor != "" && !single {
+		return fmt.Errorf("cursor can only be used when listing single tag, query or time range")
+	}
+
+	// clients which do not know about pages get all files, limit is only applied if it is set explicitly or cursor is used
+	default_limit := 0
+	if lr.Cursor != "" {
+		default_limit = DefaultListLimit
+	}
+
+	return lr.check_page(default_limit)
+}
+
+// check_page validates page parameters and fills in defaults, zero @default_limit means unlimited listing
+func (lr *ListRequest) check_page(default_limit int) error {
+	switch lr.Sort {
+	case "":
+		lr.Sort = SortName
+	case SortName, SortTimestamp, SortSize:
+	default:
+		return fmt.Errorf("invalid sort key '%s', allowed keys: %s, %s, %s", lr.Sort, SortName, SortTimestamp, SortSize)
+	}
+
+	switch lr.Order {
+	case "":
+		lr.Order = OrderAsc
+	case OrderAsc, OrderDesc:
+	default:
+		return fmt.Errorf("invalid order '%s', must be either %s or %s", lr.Order, OrderAsc, OrderDesc)
+	}
+
+	if lr.Limit == 0 {
+		lr.Limit = default_limit
+		if lr.Limit == 0 {
+			return nil
+		}
+	}
+	if lr.Limit < 0 || lr.Limit > MaxListLimit {
+		return fmt.Errorf("invalid limit %d, must be between 1 and %d", lr.Limit, MaxListLimit)
+	}
+
+	if lr.Cursor != "" {
+		cur, err := decode_cursor(lr.Cursor)
+		if err != nil {
+			return err
+		}
+		if cur.Sort != lr.Sort || cur.Order != lr.Order {
+			return fmt.Errorf("cursor has been created for sort '%s %s', not '%s %s'", cur.Sort, cur.Order, lr.Sort, lr.Order)
+		}
+	}
+
+	return nil
+}
+
+// cursor is the position of the last file of the page, it is passed to clients as opaque base64 string
+type cursor struct {
+	// tag, query or search the page has been listed from
+	Source			string		`json:"source"`
+	Sort			string		`json:"sort"`
+	Order			string		`json:"order"`
+	Name			string		`json:"name"`
+	Timestamp		time.Time	`json:"timestamp"`
+	Size			uint64		`json:"size"`
+}
+
+// value returns sort key of the last file
+func (cur *cursor) value() interface{} {
+	switch cur.Sort {
+	case SortTimestamp:
+		return cur.Timestamp.UTC()
+	case SortSize:
+		return cur.Size
+	default:
+		return cur.Name
+	}
+}
+
+func encode_cursor(cur *cursor) (string, error) {
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return "", fmt.Errorf("could not pack cursor: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decode_cursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s': %v", s, err)
+	}
+
+	var cur cursor
+	err = json.Unmarshal(data, &cur)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s': %v", s, err)
+	}
+
+	return &cur, nil
+}
+
+// files of the user which have given tag
+const tag_condition string = "EXISTS (SELECT 1 FROM `file_tags` ft JOIN `tags` t ON t.`id`=ft.`tag_id` " +
+	"WHERE ft.`file_id`=f.`id` AND t.`username`=? AND t.`tag`=?)"
+
+// list_page returns single page of user's files matching @cond, @source is what files are listed from (tag or query),
+// it is saved in the cursor, so that cursor can not be used to continue listing of something else
+func (idx *Indexer) list_page(cond string, cond_args []interface{}, source string, lr *ListRequest) (*LReply, error) {
+	column := "f.`" + lr.Sort + "`"
+	dir, cmp := "ASC", ">"
+	if lr.Order == OrderDesc {
+		dir, cmp = "DESC", "<"
+	}
+
+	range_cond, range_args := lr.range_condition()
+	cond = "f.`username`=? AND " + cond + range_cond
+	cond_args = append(append([]interface{}{idx.username}, cond_args...), range_args...)
+
+	query := "SELECT f.`bucket`,f.`name`,f.`timestamp`,f.`size`,f.`content_type`,f.`media` FROM `files` f WHERE " + cond
+	args := append([]interface{}{}, cond_args...)
+
+	if lr.Cursor != "" {
+		cur, err := decode_cursor(lr.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cur.Source != source {
+			return nil, fmt.Errorf("cursor belongs to '%s', not '%s'", cur.Source, source)
+		}
+
+		// name is unique per user, so it breaks ties of the sort key
+		if lr.Sort == SortName {
+			query += " AND f.`name` " + cmp + " ?"
+			args = append(args, cur.Name)
+		} else {
+			query += " AND (" + column + " " + cmp + " ? OR (" + column + " = ? AND f.`name` " + cmp + " ?))"
+			args = append(args, cur.value(), cur.value(), cur.Name)
+		}
+	}
+
+	if lr.Sort == SortName {
+		query += " ORDER BY f.`name` " + dir
+	} else {
+		query += " ORDER BY " + column + " " + dir + ", f.`name` " + dir
+	}
+
+	// one more row tells whether there is the next page, zero limit lists all files in one page
+	if lr.Limit != 0 {
+		query += " LIMIT ?"
+		args = append(args, lr.Limit + 1)
+	}
+
+	rows, err := idx.ctl.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := idx.scan_files(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &LReply {
+		Keys:		keys,
+	}
+
+	// counts do not depend on the page, they are only returned with the first one
+	if lr.Calendar != "" && lr.Cursor == "" {
+		reply.Calendar, err = idx.calendar(cond, cond_args, lr.Calendar)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if lr.Limit != 0 && len(keys) > lr.Limit {
+		reply.Keys = keys[:lr.Limit]
+
+		last := reply.Keys[lr.Limit - 1]
+		reply.Next, err = encode_cursor(&cursor {
+			Source:		source,
+			Sort:		lr.Sort,
+			Order:		lr.Order,
+			Name:		last.Name,
+			Timestamp:	last.Timestamp,
+			Size:		last.Size,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+// calendar returns number and size of the files matching @cond grouped by period,
+// it uses (username, timestamp) index instead of date tags
+func (idx *Indexer) calendar(cond string, args []interface{}, calendar string) ([]CalendarEntry, error) {
+	period := "DATE_FORMAT(f.`timestamp`, '" + calendarFormats[calendar] + "')"
+
+	rows, err := idx.ctl.db.Query("SELECT " + period + " AS `period`, COUNT(*), COALESCE(SUM(f.`size`),0) FROM `files` f " +
+		"WHERE " + cond + " GROUP BY `period` ORDER BY `period`", args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s calendar: %v", calendar, err)
+	}
+	defer rows.Close()
+
+	entries := make([]CalendarEntry, 0)
+	for rows.Next() {
+		var e CalendarEntry
+
+		err = rows.Scan(&e.Period, &e.Files, &e.Size)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return entries, nil
+}
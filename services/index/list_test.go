@@ -0,0 +1,154 @@
+package index
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	ts := time.Date(2016, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []cursor {
+		{Source: "video", Sort: SortName, Order: OrderAsc, Name: "a.jpg"},
+		{Source: "query:video AND NOT archived", Sort: SortTimestamp, Order: OrderDesc, Name: "b.mp4", Timestamp: ts},
+		{Source: "range", Sort: SortSize, Order: OrderAsc, Name: "name with spaces & symbols", Size: 1 << 40},
+	}
+
+	for _, test := range tests {
+		s, err := encode_cursor(&test)
+		if err != nil {
+			t.Errorf("%+v: could not encode cursor: %v", test, err)
+			continue
+		}
+
+		cur, err := decode_cursor(s)
+		if err != nil {
+			t.Errorf("%+v: could not decode cursor '%s': %v", test, s, err)
+			continue
+		}
+
+		if cur.Source != test.Source || cur.Sort != test.Sort || cur.Order != test.Order || cur.Name != test.Name ||
+				!cur.Timestamp.Equal(test.Timestamp) || cur.Size != test.Size {
+			t.Errorf("decoded cursor: %+v, want: %+v", *cur, test)
+		}
+	}
+
+	for _, s := range []string{"not base64!", "bm90IGpzb24", ""} {
+		_, err := decode_cursor(s)
+		if err == nil {
+			t.Errorf("invalid cursor '%s' has been accepted", s)
+		}
+	}
+}
+
+func TestCursorValue(t *testing.T) {
+	ts := time.Date(2016, 5, 1, 12, 30, 0, 0, time.FixedZone("MSK", 3 * 60 * 60))
+	cur := cursor {
+		Name:		"a.jpg",
+		Timestamp:	ts,
+		Size:		100,
+	}
+
+	cur.Sort = SortName
+	if v := cur.value(); v != "a.jpg" {
+		t.Errorf("name value: %v", v)
+	}
+	cur.Sort = SortSize
+	if v := cur.value(); v != uint64(100) {
+		t.Errorf("size value: %v", v)
+	}
+	cur.Sort = SortTimestamp
+	if v, ok := cur.value().(time.Time); !ok || !v.Equal(ts) || v.Location() != time.UTC {
+		t.Errorf("timestamp value: %v, want: %v in UTC", cur.value(), ts)
+	}
+}
+
+func TestListRequestCheck(t *testing.T) {
+	cursor_asc, err := encode_cursor(&cursor{Source: "video", Sort: SortName, Order: OrderAsc, Name: "a.jpg"})
+	if err != nil {
+		t.Fatalf("could not encode cursor: %v", err)
+	}
+	from := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name			string
+		lr			ListRequest
+		ok			bool
+		limit			int
+	}{
+		{"unlimited by default", ListRequest{Tags: []string{"video", "audio"}}, true, 0},
+		{"explicit limit", ListRequest{Tags: []string{"video"}, Limit: 10}, true, 10},
+		{"default limit with cursor", ListRequest{Tags: []string{"video"}, Cursor: cursor_asc}, true, DefaultListLimit},
+		{"cursor with query", ListRequest{Query: "video", Cursor: cursor_asc, Limit: 5}, true, 5},
+		{"cursor with time range", ListRequest{From: from, Cursor: cursor_asc}, true, DefaultListLimit},
+		{"cursor with several tags", ListRequest{Tags: []string{"video", "audio"}, Cursor: cursor_asc}, false, 0},
+		{"cursor for other order", ListRequest{Tags: []string{"video"}, Cursor: cursor_asc, Order: OrderDesc}, false, 0},
+		{"cursor for other sort", ListRequest{Tags: []string{"video"}, Cursor: cursor_asc, Sort: SortSize}, false, 0},
+		{"invalid cursor", ListRequest{Tags: []string{"video"}, Cursor: "garbage!"}, false, 0},
+		{"negative limit", ListRequest{Tags: []string{"video"}, Limit: -1}, false, 0},
+		{"too large limit", ListRequest{Tags: []string{"video"}, Limit: MaxListLimit + 1}, false, 0},
+		{"max limit", ListRequest{Tags: []string{"video"}, Limit: MaxListLimit}, true, MaxListLimit},
+		{"invalid sort", ListRequest{Tags: []string{"video"}, Sort: "owner"}, false, 0},
+		{"invalid order", ListRequest{Tags: []string{"video"}, Order: "up"}, false, 0},
+		{"invalid tag", ListRequest{Tags: []string{"bad/tag"}}, false, 0},
+		{"tags and query", ListRequest{Tags: []string{"video"}, Query: "audio"}, false, 0},
+		{"invalid query", ListRequest{Query: "video AND"}, false, 0},
+		{"empty time range", ListRequest{From: from, To: from}, false, 0},
+		{"inverted time range", ListRequest{From: from, To: from.Add(-time.Hour)}, false, 0},
+		{"calendar", ListRequest{From: from, Calendar: CalendarMonth}, true, 0},
+		{"invalid calendar", ListRequest{From: from, Calendar: "week"}, false, 0},
+	}
+
+	for _, test := range tests {
+		lr := test.lr
+		err := lr.Check()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error: %v, must succeed: %v", test.name, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if lr.Limit != test.limit {
+			t.Errorf("%s: limit: %d, want: %d", test.name, lr.Limit, test.limit)
+		}
+		if test.lr.Sort == "" && lr.Sort != SortName {
+			t.Errorf("%s: default sort: %s, want: %s", test.name, lr.Sort, SortName)
+		}
+		if test.lr.Order == "" && lr.Order != OrderAsc {
+			t.Errorf("%s: default order: %s, want: %s", test.name, lr.Order, OrderAsc)
+		}
+	}
+}
+
+func TestRangeCondition(t *testing.T) {
+	from := time.Date(2016, 5, 1, 3, 0, 0, 0, time.FixedZone("MSK", 3 * 60 * 60))
+	to := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		lr			ListRequest
+		cond			string
+		args			int
+	}{
+		{ListRequest{}, "", 0},
+		{ListRequest{From: from}, " AND f.`timestamp` >= ?", 1},
+		{ListRequest{To: to}, " AND f.`timestamp` < ?", 1},
+		{ListRequest{From: from, To: to}, " AND f.`timestamp` >= ? AND f.`timestamp` < ?", 2},
+	}
+
+	for _, test := range tests {
+		cond, args := test.lr.range_condition()
+		if cond != test.cond || len(args) != test.args {
+			t.Errorf("from: %s, to: %s: condition: '%s', args: %v, want: '%s' with %d args",
+				test.lr.From, test.lr.To, cond, args, test.cond, test.args)
+			continue
+		}
+
+		for _, a := range args {
+			if ts := a.(time.Time); ts.Location() != time.UTC {
+				t.Errorf("from: %s, to: %s: argument %s is not in UTC", test.lr.From, test.lr.To, ts)
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package index
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/bioothod/apparat/services/common"
+	"github.com/go-sql-driver/mysql"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// legacy index was a table per user per tag named 'username:tag' plus 'username:meta' table with the list of user's tags
+
+const legacyMetaSuffix string = ":" + MetaTag
+
+// quote returns identifier quoted for MySQL, backticks inside are doubled
+func quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func legacy_table(username, tag string) string {
+	return username + ":" + tag
+}
+
+// LegacyUsers returns users who still have legacy per-tag index tables
+func (ctl *IndexCtl) LegacyUsers() ([]string, error) {
+	rows, err := ctl.db.Query("SELECT `table_name` FROM `information_schema`.`tables` " +
+		"WHERE `table_schema`=DATABASE() AND `table_name` LIKE ?", "%" + legacyMetaSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list legacy meta tables: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]string, 0)
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		users = append(users, strings.TrimSuffix(table, legacyMetaSuffix))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return users, nil
+}
+
+// legacy_tags returns nil if user does not have legacy meta table
+func (ctl *IndexCtl) legacy_tags(username string) ([]string, error) {
+	meta := legacy_table(username, MetaTag)
+
+	rows, err := ctl.db.Query("SELECT `tag` FROM " + quote(meta))
+	if err != nil {
+		e, ok := err.(*mysql.MySQLError)
+		if ok && e.Number == 1146 {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("could not read tags from legacy meta table '%s': %v", meta, err)
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return tags, nil
+}
+
+// legacy_files returns nil if there is no table for the tag
+func (ctl *IndexCtl) legacy_files(username, tag string) ([]common.Reply, error) {
+	table := legacy_table(username, tag)
+
+	rows, err := ctl.db.Query("SELECT `bucket`,`name`,`timestamp`,`size` FROM " + quote(table))
+	if err != nil {
+		e, ok := err.(*mysql.MySQLError)
+		if ok && e.Number == 1146 {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("could not read files from legacy table '%s': %v", table, err)
+	}
+	defer rows.Close()
+
+	files := make([]common.Reply, 0)
+	for rows.Next() {
+		var f common.Reply
+
+		err = rows.Scan(&f.Bucket, &f.Name, &f.Timestamp, &f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		files = append(files, f)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return files, nil
+}
+
+// legacy_user_files returns files from all legacy tables of the user which have not been migrated yet
+func (ctl *IndexCtl) legacy_user_files(username string) ([]common.Reply, error) {
+	tags, err := ctl.legacy_tags(username)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	files := make([]common.Reply, 0)
+	for _, tag := range tags {
+		tfiles, err := ctl.legacy_files(username, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range tfiles {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				files = append(files, f)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// legacy_drop drops all legacy tables of the user, including tables of tags missing from the meta table
+func (ctl *IndexCtl) legacy_drop(username string) error {
+	prefix := legacy_table(username, "")
+
+	rows, err := ctl.db.Query("SELECT `table_name` FROM `information_schema`.`tables` " +
+		"WHERE `table_schema`=DATABASE() AND `table_name` LIKE ?", escape_like(prefix) + "%")
+	if err != nil {
+		return fmt.Errorf("could not list legacy tables of user '%s': %v", username, err)
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			return fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		// table names may be compared case-insensitively, other user's tables must not be touched
+		if strings.HasPrefix(table, prefix) {
+			tables = append(tables, table)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("could not scan database: %v", err)
+	}
+
+	for _, table := range tables {
+		_, err = ctl.db.Exec("DROP TABLE IF EXISTS " + quote(table))
+		if err != nil {
+			return fmt.Errorf("could not drop legacy table '%s': %v", table, err)
+		}
+	}
+
+	return nil
+}
+
+var legacyTagCleaner = regexp.MustCompile("[^A-Za-z0-9_.-]+")
+
+// legacy_tag_names maps legacy tags which do not pass CheckTag() to valid names,
+// mapping only depends on the set of legacy tags, so repeated migration produces the same names
+func legacy_tag_names(tags []string) map[string]string {
+	taken := make(map[string]bool)
+	for _, tag := range ReservedTags {
+		taken[tag] = true
+	}
+
+	invalid := make([]string, 0)
+	for _, tag := range tags {
+		if CheckTag(tag) == nil {
+			taken[tag] = true
+		} else {
+			invalid = append(invalid, tag)
+		}
+	}
+	sort.Strings(invalid)
+
+	names := make(map[string]string)
+	for _, tag := range invalid {
+		name := legacyTagCleaner.ReplaceAllString(tag, "_")
+		if len(name) > 32 {
+			name = name[:32]
+		}
+
+		// cleaned name is already used, make it unique using the legacy name
+		if name == "" || taken[name] {
+			sum := sha256.Sum256([]byte(tag))
+			suffix := fmt.Sprintf("-%x", sum[:4])
+			if len(name) > 32 - len(suffix) {
+				name = name[:32 - len(suffix)]
+			}
+			name += suffix
+		}
+
+		taken[name] = true
+		names[tag] = name
+	}
+
+	return names
+}
+
+type MigrateStats struct {
+	Tags			int
+	Files			int
+	// legacy tags which did not pass validation and have been migrated under new names
+	Renamed			map[string]string
+}
+
+// MigrateUser copies legacy per-tag tables of the user into normalized tables.
+// Copying is idempotent, so migration can be repeated if it fails halfway.
+// Legacy tables are dropped after all tags have been copied if @drop is true.
+func (ctl *IndexCtl) MigrateUser(username string, drop bool) (*MigrateStats, error) {
+	idx, err := NewIndexer(username, ctl)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := ctl.legacy_tags(username)
+	if err != nil {
+		return nil, err
+	}
+
+	names := legacy_tag_names(tags)
+
+	stats := &MigrateStats {
+		Renamed:	make(map[string]string),
+	}
+	for _, tag := range tags {
+		files, err := ctl.legacy_files(username, tag)
+		if err != nil {
+			return stats, err
+		}
+		if files == nil {
+			continue
+		}
+
+		// tags created before validation was introduced could not be listed, removed or renamed otherwise
+		name := tag
+		if n, ok := names[tag]; ok {
+			name = n
+			stats.Renamed[tag] = n
+		}
+
+		err = idx.index_files(name, files)
+		if err != nil {
+			return stats, fmt.Errorf("could not migrate tag '%s' of user '%s' as '%s': %v", tag, username, name, err)
+		}
+
+		stats.Tags++
+		stats.Files += len(files)
+	}
+
+	if !drop {
+		return stats, nil
+	}
+
+	for _, tag := range tags {
+		table := legacy_table(username, tag)
+		_, err = ctl.db.Exec("DROP TABLE IF EXISTS " + quote(table))
+		if err != nil {
+			return stats, fmt.Errorf("could not drop legacy table '%s': %v", table, err)
+		}
+	}
+
+	meta := legacy_table(username, MetaTag)
+	_, err = ctl.db.Exec("DROP TABLE IF EXISTS " + quote(meta))
+	if err != nil {
+		return stats, fmt.Errorf("could not drop legacy meta table '%s': %v", meta, err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,48 @@
+package index
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLegacyTagNames(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	tags := []string{"video", "my photos", "my_photos", "my photos!", "bad/tag", long, "", MetaTag}
+
+	names := legacy_tag_names(tags)
+
+	for _, tag := range []string{"video", "my_photos", MetaTag} {
+		if n, ok := names[tag]; ok {
+			t.Errorf("valid tag '%s' has been renamed to '%s'", tag, n)
+		}
+	}
+
+	seen := map[string]bool{"video": true, "my_photos": true, MetaTag: true, AllTag: true}
+	for _, tag := range []string{"my photos", "my photos!", "bad/tag", long, ""} {
+		n, ok := names[tag]
+		if !ok {
+			t.Errorf("invalid tag '%s' has not been renamed", tag)
+			continue
+		}
+		if err := CheckTag(n); err != nil {
+			t.Errorf("tag '%s' has been renamed to invalid name: %v", tag, err)
+		}
+		if seen[n] {
+			t.Errorf("tag '%s' has been renamed to '%s' which is already used", tag, n)
+		}
+		seen[n] = true
+	}
+
+	if names["bad/tag"] != "bad_tag" || names[long] != long[:32] {
+		t.Errorf("unique names have been changed more than needed: %v", names)
+	}
+
+	reversed := make([]string, 0, len(tags))
+	for i := len(tags) - 1; i >= 0; i-- {
+		reversed = append(reversed, tags[i])
+	}
+	if again := legacy_tag_names(reversed); !reflect.DeepEqual(again, names) {
+		t.Errorf("mapping depends on tag order: %v, previous: %v", again, names)
+	}
+}
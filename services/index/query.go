@@ -0,0 +1,188 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maximum number of tags in a single query, every tag becomes a subquery
+const MaxQueryTags int = 32
+
+const (
+	QueryTag string = "tag"
+	QueryAnd string = "and"
+	QueryOr string = "or"
+	QueryNot string = "not"
+)
+
+// QueryNode is a node of parsed boolean query, @Tag is only set for QueryTag nodes,
+// @Args are operands of QueryAnd, QueryOr (two or more) and QueryNot (exactly one) nodes
+type QueryNode struct {
+	Op			string
+	Tag			string
+	Args			[]*QueryNode
+}
+
+type query_parser struct {
+	tokens			[]string
+	pos			int
+	tags			int
+}
+
+func tokenize_query(query string) []string {
+	query = strings.Replace(query, "(", " ( ", -1)
+	query = strings.Replace(query, ")", " ) ", -1)
+	return strings.Fields(query)
+}
+
+func (p *query_parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *query_parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *query_parser) keyword(kw string) bool {
+	if strings.EqualFold(p.peek(), kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expr := and ('OR' and)*
+func (p *query_parser) expr() (*QueryNode, error) {
+	return p.binary(QueryOr, p.and)
+}
+
+// and := unary ('AND' unary)*
+func (p *query_parser) and() (*QueryNode, error) {
+	return p.binary(QueryAnd, p.unary)
+}
+
+func (p *query_parser) binary(op string, operand func() (*QueryNode, error)) (*QueryNode, error) {
+	n, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []*QueryNode{n}
+	for p.keyword(op) {
+		n, err = operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, n)
+	}
+
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return &QueryNode {
+		Op:		op,
+		Args:		args,
+	}, nil
+}
+
+// unary := 'NOT' unary | '(' expr ')' | tag
+func (p *query_parser) unary() (*QueryNode, error) {
+	if p.keyword(QueryNot) {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &QueryNode {
+			Op:		QueryNot,
+			Args:		[]*QueryNode{n},
+		}, nil
+	}
+
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of query, tag, 'NOT' or '(' expected")
+	case t == "(":
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return n, nil
+	case t == ")", strings.EqualFold(t, QueryAnd), strings.EqualFold(t, QueryOr):
+		return nil, fmt.Errorf("unexpected '%s', tag, 'NOT' or '(' expected", t)
+	}
+
+	err := CheckTag(t)
+	if err != nil {
+		return nil, err
+	}
+
+	p.tags++
+	if p.tags > MaxQueryTags {
+		return nil, fmt.Errorf("too many tags, at most %d are allowed", MaxQueryTags)
+	}
+
+	return &QueryNode {
+		Op:		QueryTag,
+		Tag:		t,
+	}, nil
+}
+
+// ParseQuery parses boolean expression over tags, operators are 'AND', 'OR' and 'NOT' (case-insensitive)
+// with usual precedence (NOT binds tighter than AND, AND binds tighter than OR), parentheses group subexpressions,
+// for example 'video AND 2016-05-01 AND NOT archived'. Tags named like operators can not be used in queries.
+func ParseQuery(query string) (*QueryNode, error) {
+	p := &query_parser {
+		tokens:		tokenize_query(query),
+	}
+
+	n, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid query '%s': %v", query, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid query '%s': unexpected '%s', 'AND' or 'OR' expected", query, p.peek())
+	}
+
+	return n, nil
+}
+
+// sql returns condition on files table aliased as 'f'
+func (n *QueryNode) sql(username string) (string, []interface{}) {
+	switch n.Op {
+	case QueryTag:
+		return tag_condition, []interface{}{username, n.Tag}
+	case QueryNot:
+		cond, args := n.Args[0].sql(username)
+		return "NOT " + cond, args
+	}
+
+	conds := make([]string, 0, len(n.Args))
+	args := make([]interface{}, 0)
+	for _, a := range n.Args {
+		c, a_args := a.sql(username)
+		conds = append(conds, c)
+		args = append(args, a_args...)
+	}
+
+	return "(" + strings.Join(conds, " " + strings.ToUpper(n.Op) + " ") + ")", args
+}
+
+func (idx *Indexer) compile_query(query string) (string, []interface{}, error) {
+	n, err := ParseQuery(query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cond, args := n.sql(idx.username)
+	return cond, args, nil
+}
@@ -0,0 +1,111 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// render prints query tree as s-expression, like (and video (not archived))
+func render(n *QueryNode) string {
+	if n.Op == QueryTag {
+		return n.Tag
+	}
+
+	args := make([]string, 0, len(n.Args))
+	for _, a := range n.Args {
+		args = append(args, render(a))
+	}
+	return "(" + n.Op + " " + strings.Join(args, " ") + ")"
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query			string
+		tree			string
+	}{
+		{"video", "video"},
+		{"  video  ", "video"},
+		{"video AND 2016-05-01", "(and video 2016-05-01)"},
+		{"video and audio or image", "(or (and video audio) image)"},
+		{"video OR audio AND image", "(or video (and audio image))"},
+		{"a AND b AND c", "(and a b c)"},
+		{"a OR b OR c", "(or a b c)"},
+		{"NOT archived", "(not archived)"},
+		{"not not archived", "(not (not archived))"},
+		{"video AND NOT archived", "(and video (not archived))"},
+		{"NOT video OR audio", "(or (not video) audio)"},
+		{"(video OR audio) AND 2016-05-01", "(and (or video audio) 2016-05-01)"},
+		{"(video)", "video"},
+		{"NOT (a OR b)", "(not (or a b))"},
+		{"video AND (2016-05-01 OR 2016-05-02) AND NOT archived",
+			"(and video (or 2016-05-01 2016-05-02) (not archived))"},
+		{"a AND(b OR c)", "(and a (or b c))"},
+		{"Or_tag And_tag", ""},
+		{"", ""},
+		{"AND", ""},
+		{"video AND", ""},
+		{"video OR OR audio", ""},
+		{"video audio", ""},
+		{"(video", ""},
+		{"video)", ""},
+		{"()", ""},
+		{"NOT", ""},
+		{"bad/tag", ""},
+		{"tag-with-too-many-characters-in-it-000", ""},
+	}
+
+	for _, test := range tests {
+		n, err := ParseQuery(test.query)
+		if test.tree == "" {
+			if err == nil {
+				t.Errorf("query '%s': invalid query has been accepted: %s", test.query, render(n))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("query '%s': %v", test.query, err)
+			continue
+		}
+		if tree := render(n); tree != test.tree {
+			t.Errorf("query '%s': tree: %s, want: %s", test.query, tree, test.tree)
+		}
+	}
+}
+
+func TestParseQueryTagLimit(t *testing.T) {
+	tags := make([]string, 0, MaxQueryTags + 1)
+	for i := 0; i <= MaxQueryTags; i++ {
+		tags = append(tags, fmt.Sprintf("t%d", i))
+	}
+
+	_, err := ParseQuery(strings.Join(tags[:MaxQueryTags], " OR "))
+	if err != nil {
+		t.Errorf("query with %d tags: %v", MaxQueryTags, err)
+	}
+
+	_, err = ParseQuery(strings.Join(tags, " OR "))
+	if err == nil {
+		t.Errorf("query with %d tags has been accepted", len(tags))
+	}
+}
+
+func TestQuerySQL(t *testing.T) {
+	n, err := ParseQuery("video AND NOT (archived OR 2016-05-01)")
+	if err != nil {
+		t.Fatalf("could not parse query: %v", err)
+	}
+
+	cond, args := n.sql("alice")
+
+	want := "(" + tag_condition + " AND NOT (" + tag_condition + " OR " + tag_condition + "))"
+	if cond != want {
+		t.Errorf("condition: %s, want: %s", cond, want)
+	}
+
+	want_args := []interface{}{"alice", "video", "alice", "archived", "alice", "2016-05-01"}
+	if fmt.Sprint(args) != fmt.Sprint(want_args) {
+		t.Errorf("arguments: %v, want: %v", args, want_args)
+	}
+}
@@ -0,0 +1,142 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SearchRequest selects user's files by name and metadata, all set fields must match
+type SearchRequest struct {
+	// name starts with @Prefix and contains @Name
+	Prefix		string			`json:"prefix"`
+	Name		string			`json:"name"`
+
+	// size range in bytes, inclusive
+	MinSize		*uint64			`json:"min_size"`
+	MaxSize		*uint64			`json:"max_size"`
+
+	// timestamp range [@From, @To) like in list request, either bound can be omitted
+	From		time.Time		`json:"from"`
+	To		time.Time		`json:"to"`
+
+	// exact content type like 'image/jpeg' or its major type with trailing slash like 'image/'
+	ContentType	string			`json:"content_type"`
+
+	// search results are always paged, DefaultListLimit if not set
+	Limit		int			`json:"limit"`
+	Cursor		string			`json:"cursor"`
+	Sort		string			`json:"sort"`
+	Order		string			`json:"order"`
+}
+
+func (sr *SearchRequest) list_request() *ListRequest {
+	return &ListRequest {
+		From:		sr.From,
+		To:		sr.To,
+		Limit:		sr.Limit,
+		Cursor:		sr.Cursor,
+		Sort:		sr.Sort,
+		Order:		sr.Order,
+	}
+}
+
+// Check validates search request
+func (sr *SearchRequest) Check() error {
+	_, err := sr.check()
+	return err
+}
+
+// check validates search request and returns its page parameters with defaults filled in
+func (sr *SearchRequest) check() (*ListRequest, error) {
+	if sr.Prefix == "" && sr.Name == "" && sr.MinSize == nil && sr.MaxSize == nil &&
+			sr.From.IsZero() && sr.To.IsZero() && sr.ContentType == "" {
+		return nil, fmt.Errorf("search request does not contain any condition")
+	}
+
+	if sr.MinSize != nil && sr.MaxSize != nil && *sr.MinSize > *sr.MaxSize {
+		return nil, fmt.Errorf("invalid size range: min_size %d is greater than max_size %d", *sr.MinSize, *sr.MaxSize)
+	}
+	if !sr.From.IsZero() && !sr.To.IsZero() && !sr.To.After(sr.From) {
+		return nil, fmt.Errorf("invalid time range: to %s must be after from %s", sr.To, sr.From)
+	}
+
+	lr := sr.list_request()
+	err := lr.check_page(DefaultListLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	return lr, nil
+}
+
+// escape_like escapes LIKE wildcards, so that string is matched literally
+func escape_like(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "%", "\\%", -1)
+	s = strings.Replace(s, "_", "\\_", -1)
+	return s
+}
+
+// condition returns condition on files table aliased as 'f', time range is added by list_page()
+func (sr *SearchRequest) condition() (string, []interface{}) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if sr.Prefix != "" {
+		conds = append(conds, "f.`name` LIKE ?")
+		args = append(args, escape_like(sr.Prefix) + "%")
+	}
+	if sr.Name != "" {
+		conds = append(conds, "f.`name` LIKE ?")
+		args = append(args, "%" + escape_like(sr.Name) + "%")
+	}
+	if sr.MinSize != nil {
+		conds = append(conds, "f.`size` >= ?")
+		args = append(args, *sr.MinSize)
+	}
+	if sr.MaxSize != nil {
+		conds = append(conds, "f.`size` <= ?")
+		args = append(args, *sr.MaxSize)
+	}
+	if sr.ContentType != "" {
+		if strings.HasSuffix(sr.ContentType, "/") {
+			conds = append(conds, "f.`content_type` LIKE ?")
+			args = append(args, escape_like(sr.ContentType) + "%")
+		} else {
+			conds = append(conds, "f.`content_type` = ?")
+			args = append(args, sr.ContentType)
+		}
+	}
+
+	// search by time range only
+	if len(conds) == 0 {
+		return "TRUE", args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// Search returns single page of files matching search request
+func (idx *Indexer) Search(sr *SearchRequest) (*LReply, error) {
+	lr, err := sr.check()
+	if err != nil {
+		return nil, err
+	}
+
+	// cursor can only continue the same search
+	filter := *sr
+	filter.Limit, filter.Cursor, filter.Sort, filter.Order = 0, "", "", ""
+	source, err := json.Marshal(&filter)
+	if err != nil {
+		return nil, fmt.Errorf("could not pack search request: %v", err)
+	}
+
+	cond, args := sr.condition()
+	reply, err := idx.list_page(cond, args, "search:" + string(source), lr)
+	if err != nil {
+		return nil, fmt.Errorf("could not search files: %v", err)
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,65 @@
+package index
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchRequestCheck(t *testing.T) {
+	size := func(v uint64) *uint64 {
+		return &v
+	}
+	from := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name			string
+		sr			SearchRequest
+		ok			bool
+		limit			int
+	}{
+		{"prefix", SearchRequest{Prefix: "IMG_"}, true, DefaultListLimit},
+		{"size range", SearchRequest{MinSize: size(10), MaxSize: size(10)}, true, DefaultListLimit},
+		{"time range", SearchRequest{From: from, To: from.Add(time.Hour), Limit: 20}, true, 20},
+		{"content type", SearchRequest{ContentType: "image/"}, true, DefaultListLimit},
+		{"no conditions", SearchRequest{Limit: 10}, false, 0},
+		{"inverted size range", SearchRequest{MinSize: size(11), MaxSize: size(10)}, false, 0},
+		{"empty time range", SearchRequest{From: from, To: from}, false, 0},
+		{"too large limit", SearchRequest{Name: "a", Limit: MaxListLimit + 1}, false, 0},
+	}
+
+	for _, test := range tests {
+		lr, err := test.sr.check()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error: %v, must succeed: %v", test.name, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if lr.Limit != test.limit {
+			t.Errorf("%s: limit: %d, want: %d", test.name, lr.Limit, test.limit)
+		}
+		if !lr.From.Equal(test.sr.From) || !lr.To.Equal(test.sr.To) {
+			t.Errorf("%s: page time range: [%s, %s), want: [%s, %s)", test.name, lr.From, lr.To, test.sr.From, test.sr.To)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		s			string
+		escaped			string
+	}{
+		{"IMG_0001", "IMG\\_0001"},
+		{"100%", "100\\%"},
+		{"a\\b", "a\\\\b"},
+		{"plain", "plain"},
+	}
+
+	for _, test := range tests {
+		if e := escape_like(test.s); e != test.escaped {
+			t.Errorf("'%s': escaped: '%s', want: '%s'", test.s, e, test.escaped)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// every file is indexed in this tag, it is used to count usage and list all files
+const AllTag string = "all"
+
+// reserved tags can not be removed, renamed or created by renaming
+var ReservedTags = []string{AllTag, MetaTag}
+
+func CheckUserTag(tag string) error {
+	err := CheckTag(tag)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ReservedTags {
+		if tag == r {
+			return fmt.Errorf("tag '%s' is reserved", tag)
+		}
+	}
+
+	return nil
+}
+
+// CheckUntag validates untag request, files can not be removed from reserved tags
+func (ireq *IndexRequest) CheckUntag() error {
+	for _, req := range ireq.Files {
+		for _, tag := range req.Tags {
+			err := CheckUserTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type RenameRequest struct {
+	Tag		string		`json:"tag"`
+	New		string		`json:"new"`
+}
+
+type DeleteRequest struct {
+	Tag		string		`json:"tag"`
+}
+
+// drop_empty_tag removes tag which does not have files anymore, so that it disappears from the list of user's tags
+func (idx *Indexer) drop_empty_tag(tx *sql.Tx, tag string) error {
+	_, err := tx.Exec("DELETE t FROM `tags` t WHERE t.`username`=? AND t.`tag`=? " +
+		"AND NOT EXISTS (SELECT 1 FROM `file_tags` ft WHERE ft.`tag_id`=t.`id`)", idx.username, tag)
+	if err != nil {
+		return fmt.Errorf("could not remove empty tag '%s': %v", tag, err)
+	}
+
+	return nil
+}
+
+// Untag removes tags from files, files themselves stay indexed, tags left without files are removed
+func (idx *Indexer) Untag(ireq *IndexRequest) error {
+	err := ireq.CheckUntag()
+	if err != nil {
+		return err
+	}
+
+	tx, err := idx.ctl.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for tag, files := range ReformatIndexRequest(ireq).Tags {
+		for start := 0; start < len(files); start += IndexBatchSize {
+			end := start + IndexBatchSize
+			if end > len(files) {
+				end = len(files)
+			}
+
+			args := []interface{}{idx.username, tag}
+			for _, f := range files[start:end] {
+				args = append(args, f.Name)
+			}
+
+			_, err = tx.Exec("DELETE ft FROM `file_tags` ft " +
+				"JOIN `tags` t ON t.`id`=ft.`tag_id` " +
+				"JOIN `files` f ON f.`id`=ft.`file_id` " +
+				"WHERE t.`username`=? AND t.`tag`=? AND f.`name` IN (" + placeholders("?", end - start) + ")",
+				args...)
+			if err != nil {
+				return fmt.Errorf("could not remove tag '%s' from %d files: %v", tag, end - start, err)
+			}
+		}
+
+		err = idx.drop_empty_tag(tx, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit untag: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteTag removes tag from all files and from the list of user's tags, false is returned if there is no such tag
+func (idx *Indexer) DeleteTag(tag string) (bool, error) {
+	err := CheckUserTag(tag)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := idx.ctl.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE ft FROM `file_tags` ft JOIN `tags` t ON t.`id`=ft.`tag_id` WHERE t.`username`=? AND t.`tag`=?",
+		idx.username, tag)
+	if err != nil {
+		return false, fmt.Errorf("could not remove tag '%s' from files: %v", tag, err)
+	}
+
+	res, err := tx.Exec("DELETE FROM `tags` WHERE `username`=? AND `tag`=?", idx.username, tag)
+	if err != nil {
+		return false, fmt.Errorf("could not remove tag '%s': %v", tag, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not remove tag '%s': %v", tag, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("could not commit removal of tag '%s': %v", tag, err)
+	}
+
+	return n != 0, nil
+}
+
+// RenameTag moves all files from tag @tag to tag @to, if @to already exists tags are merged,
+// false is returned if there is no tag @tag
+func (idx *Indexer) RenameTag(tag, to string) (bool, error) {
+	err := CheckUserTag(tag)
+	if err != nil {
+		return false, err
+	}
+	err = CheckUserTag(to)
+	if err != nil {
+		return false, err
+	}
+	if tag == to {
+		return false, fmt.Errorf("tag '%s' can not be renamed to itself", tag)
+	}
+
+	tx, err := idx.ctl.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var from_id int64
+	err = tx.QueryRow("SELECT `id` FROM `tags` WHERE `username`=? AND `tag`=? FOR UPDATE", idx.username, tag).Scan(&from_id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read tag '%s': %v", tag, err)
+	}
+
+	to_id, err := idx.tag_id(tx, to)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec("INSERT IGNORE INTO `file_tags` (`tag_id`, `file_id`) SELECT ?, `file_id` FROM `file_tags` WHERE `tag_id`=?",
+		to_id, from_id)
+	if err != nil {
+		return false, fmt.Errorf("could not move files from tag '%s' to '%s': %v", tag, to, err)
+	}
+
+	_, err = tx.Exec("DELETE FROM `file_tags` WHERE `tag_id`=?", from_id)
+	if err != nil {
+		return false, fmt.Errorf("could not remove files from tag '%s': %v", tag, err)
+	}
+
+	_, err = tx.Exec("DELETE FROM `tags` WHERE `id`=?", from_id)
+	if err != nil {
+		return false, fmt.Errorf("could not remove tag '%s': %v", tag, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("could not commit renaming of tag '%s' to '%s': %v", tag, to, err)
+	}
+
+	return true, nil
+}
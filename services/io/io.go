@@ -392,3 +392,56 @@ func (io *IOCtl) MetaJson(oldreq *http.Request, w http.ResponseWriter, bucket, k
 
 	return http.StatusOK, nil
 }
+
+// RemoveKey removes object from the bucket, missing object is not an error
+func (io *IOCtl) RemoveKey(bucket, key string) error {
+	session, err := elliptics.NewSession(io.node)
+	if err != nil {
+		return fmt.Errorf("could not create new session, bucket: %s, key: %s, error: %v", bucket, key, err)
+	}
+	defer session.Delete()
+
+	meta, err := io.FindBucket(bucket)
+	if err != nil {
+		return fmt.Errorf("could not find bucket: %s, key: %s, error: %v", bucket, key, err)
+	}
+	session.SetGroups(meta.Groups)
+	session.SetNamespace(meta.Name)
+
+	for rm := range session.Remove(key) {
+		err = rm.Error()
+		if err == nil {
+			continue
+		}
+
+		if e, ok := err.(*elliptics.DnetError); ok && e.Code == -2 {
+			continue
+		}
+
+		return fmt.Errorf("could not remove key, bucket: %s, key: %s, groups: %v, error: %v", meta.Name, key, meta.Groups, err)
+	}
+
+	return nil
+}
+
+// Purge removes data and metadata objects of the given files, it returns number of removed files
+// and can be called again with the same files if it fails halfway
+func (io *IOCtl) Purge(files []common.Reply, modifier common.ModifierFunc) (int, error) {
+	meta_modifier := common.MetaModifier()
+
+	for i, f := range files {
+		err := io.RemoveKey(f.Bucket, modifier(f.Name))
+		if err != nil {
+			return i, err
+		}
+
+		err = io.RemoveKey(f.Bucket, modifier(meta_modifier(f.Name)))
+		if err != nil {
+			return i, err
+		}
+
+		glog.Infof("Purge: bucket: %s, key: %s", f.Bucket, f.Name)
+	}
+
+	return len(files), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bioothod/apparat/services/index"
+	"log"
+	"os"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n" +
+			"Copies legacy per-tag index tables into normalized files, tags and file_tags tables.\n" +
+			"Deployment order:\n" +
+			"	1. apply db/index/create.sql, it only creates tables which do not exist yet\n" +
+			"	2. run this tool while the old index server is stopped, migration can be repeated if it fails\n" +
+			"	3. start the new index server, it does not list files from legacy tables\n" +
+			"Legacy tables are kept unless -drop is set, so that migrated index can be checked before they are dropped.\n\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	dbparams := flag.String("db", "", "mysql index database parameters:\n" +
+		"	user@unix(/path/to/socket)/dbname?charset=utf8&parseTime=true\n" +
+		"	user:password@tcp(localhost:5555)/dbname?charset=utf8&parseTime=true")
+	username := flag.String("user", "", "migrate only this user, all users with legacy index tables are migrated by default")
+	drop := flag.Bool("drop", false, "drop legacy per-tag tables after they have been copied")
+
+	flag.Parse()
+	if *dbparams == "" {
+		log.Fatalf("You must provide mysql index database parameters")
+	}
+
+	ctl, err := index.NewIndexCtl("mysql", *dbparams)
+	if err != nil {
+		log.Fatalf("could not connect to MySQL database '%s': %v", *dbparams, err)
+	}
+	defer ctl.Close()
+
+	users := []string{*username}
+	if *username == "" {
+		users, err = ctl.LegacyUsers()
+		if err != nil {
+			log.Fatalf("could not find users to migrate: %v", err)
+		}
+	}
+
+	failed := 0
+	for _, u := range users {
+		stats, err := ctl.MigrateUser(u, *drop)
+		if err != nil {
+			log.Printf("user: %s, migration has failed, it can be repeated: %v", u, err)
+			failed++
+			continue
+		}
+
+		for legacy, name := range stats.Renamed {
+			log.Printf("user: %s, tag '%s' is not a valid tag name, it has been migrated as '%s'", u, legacy, name)
+		}
+		log.Printf("user: %s, migrated tags: %d, renamed: %d, files: %d, legacy tables dropped: %v",
+			u, stats.Tags, len(stats.Renamed), stats.Files, *drop)
+	}
+
+	if failed != 0 {
+		log.Fatalf("migration has failed for %d of %d users", failed, len(users))
+	}
+	log.Printf("migrated %d users", len(users))
+}